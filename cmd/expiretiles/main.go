@@ -0,0 +1,120 @@
+// Command expiretiles removes the tiles listed in osm2pgsql expiry files
+// from the tile cache, e.g.
+//
+//	osm2pgsql --append --expire-tiles=14 --expire-output=dirty.list ...
+//	expiretiles -dir cache -layer osm -minzoom 0 -maxzoom 18 dirty.list
+//
+// Each listed tile is expanded to its parents and children between
+// -minzoom and -maxzoom. Without file arguments the list is read from
+// stdin.
+//
+// By default the tiles are purged from the cache files of the layer in
+// -dir and, with -render, rendered again from -url or -map. With -server
+// the list is posted to the TileServer.ExpireHandler of a running tile
+// server instead, which also drops the tiles from its in-memory cache and
+// passes the expiry on to its groupcache peers.
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/fawick/go-mapnik/maptiles"
+)
+
+func main() {
+	dir := flag.String("dir", "gomapnikcache", "directory of the cache files")
+	layer := flag.String("layer", "", "layer to expire")
+	format := flag.String("format", "png", "format of the tiles to render again")
+	minZoom := flag.Uint64("minzoom", 0, "lowest zoom level to expire")
+	maxZoom := flag.Uint64("maxzoom", 18, "highest zoom level to expire")
+	server := flag.String("server", "", "URL of the expire handler of a running tile server")
+	render := flag.Bool("render", false, "render the expired tiles again")
+	tileURL := flag.String("url", "", "URL template of the upstream tile server to render from")
+	mapFile := flag.String("map", "", "Mapnik stylesheet to render from")
+	threads := flag.Int("threads", runtime.NumCPU(), "number of tiles rendered in parallel")
+	flag.Parse()
+	if *layer == "" {
+		log.Fatal("expiretiles: -layer missing")
+	}
+
+	var list []byte
+	var err error
+	if flag.NArg() == 0 {
+		list, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		var files []io.Reader
+		for _, fn := range flag.Args() {
+			b, err := ioutil.ReadFile(fn)
+			if err != nil {
+				log.Fatal(err)
+			}
+			files = append(files, bytes.NewReader(b), strings.NewReader("\n"))
+		}
+		list, err = ioutil.ReadAll(io.MultiReader(files...))
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *server != "" {
+		q := url.Values{}
+		q.Set("layer", *layer)
+		q.Set("minzoom", strconv.FormatUint(*minZoom, 10))
+		q.Set("maxzoom", strconv.FormatUint(*maxZoom, 10))
+		res, err := http.Post(*server+"?"+q.Encode(), "text/plain", bytes.NewReader(list))
+		if err != nil {
+			log.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			log.Fatalf("expiretiles: %s: %s", res.Status, bytes.TrimSpace(body))
+		}
+		fmt.Printf("Purged %s tiles\n", bytes.TrimSpace(body))
+		return
+	}
+
+	ranges, err := maptiles.ReadExpiryList(bytes.NewReader(list), *minZoom, *maxZoom)
+	if err != nil {
+		log.Fatal(err)
+	}
+	t, err := maptiles.NewTileServer("", *dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	n, err := t.Expire(context.Background(), *layer, ranges)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var expired uint64
+	for _, r := range ranges {
+		expired += r.Size()
+	}
+	fmt.Printf("Purged %d of %d expired tiles\n", n, expired)
+
+	if *render {
+		g := maptiles.Generator{
+			MapFile:   *mapFile,
+			TileDir:   *dir,
+			Threads:   *threads,
+			LayerName: *layer,
+			Format:    *format,
+			Url:       *tileURL,
+		}
+		if err := g.RenderTiles(ranges, "expired "+*layer); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
@@ -51,8 +51,8 @@ func GenerateOSMTiles() {
 		g.TileDir = home + "/osm/tiles"
 	}
 
-	g.Run(mapnik.Coord{-180, -90}, mapnik.Coord{180, 90}, 0, 6, "World")
-	g.Run(mapnik.Coord{0, 35.0}, mapnik.Coord{16, 70}, 1, 11, "Europe")
+	g.Run(maptiles.Coord{-180, -90}, maptiles.Coord{180, 90}, 0, 6, "World")
+	g.Run(maptiles.Coord{0, 35.0}, maptiles.Coord{16, 70}, 1, 11, "Europe")
 }
 
 // Serve a single stylesheet via HTTP. Open view_tileserver.html in your browser
@@ -60,10 +60,17 @@ func GenerateOSMTiles() {
 // The created tiles are cached in an sqlite database (MBTiles 1.2 conform) so
 // successive access a tile is much faster.
 func TileserverWithCaching() {
-	cache := "gomapnikcache.sqlite"
-	os.Remove(cache)
-	t := maptiles.NewTileServer(cache)
-	t.AddMapnikLayer("default", "sampledata/stylesheet.xml")
+	cache := "gomapnikcache"
+	os.RemoveAll(cache)
+	t, err := maptiles.NewTileServer("", cache)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if err := t.AddMapnikLayer("default", "sampledata/stylesheet.xml"); err != nil {
+		fmt.Println(err)
+		return
+	}
 	http.ListenAndServe(":8080", t)
 }
 
@@ -0,0 +1,393 @@
+package maptiles
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/groupcache"
+)
+
+// CacheConfig configures the groupcache group in which TileServers keep
+// hot tiles in memory. Replicas with the same GroupName and Peers share
+// their tiles: each tile is loaded by the replica owning its key and
+// fetched from there by the others.
+type CacheConfig struct {
+	GroupName string // unique per process, defaults to "TileCache"
+	Size      int64  // bytes held in memory, 0 means 100 MB
+	// Base URL under which the other replicas reach this process, e.g.
+	// "http://10.0.0.1:8080". Empty disables peering.
+	Self     string
+	Peers    []string // base URLs of all replicas including Self, see SetPeers
+	BasePath string   // where PeerHandler is mounted, defaults to "/_groupcache/"
+	// Shared by all replicas, which send it with their expiries and reject
+	// expiries without it. Empty accepts expiries from anyone reaching
+	// PeerHandler.
+	Secret string
+}
+
+// Used by NewTileServer.
+var DefaultCacheConfig = CacheConfig{
+	GroupName: "TileCache",
+	Size:      100 << 20,
+}
+
+// groups serializes the creation of groupcache groups, which panics on
+// duplicate names.
+var groups sync.Mutex
+
+// groupcache permits a single peer pool per process, so all TileServers
+// with peering share it.
+var peerPool struct {
+	sync.Mutex
+	pool     *groupcache.HTTPPool
+	self     string
+	basePath string
+	secret   string
+	peers    []string
+	servers  map[string]*TileServer // by group name, see servePeer
+}
+
+// joinPeerPool creates the pool of the process or checks that cfg fits
+// the existing one.
+func joinPeerPool(cfg CacheConfig) (*groupcache.HTTPPool, error) {
+	peerPool.Lock()
+	defer peerPool.Unlock()
+	if peerPool.pool == nil {
+		peerPool.pool = groupcache.NewHTTPPoolOpts(cfg.Self, &groupcache.HTTPPoolOptions{BasePath: cfg.BasePath})
+		peerPool.self = cfg.Self
+		peerPool.basePath = cfg.BasePath
+		peerPool.secret = cfg.Secret
+		return peerPool.pool, nil
+	}
+	if cfg.Self != peerPool.self || cfg.BasePath != peerPool.basePath {
+		return nil, fmt.Errorf("maptiles: groupcache peer pool already serves %s%s", peerPool.self, peerPool.basePath)
+	}
+	if cfg.Secret != peerPool.secret {
+		return nil, fmt.Errorf("maptiles: groupcache peer pool has another secret")
+	}
+	return peerPool.pool, nil
+}
+
+// NewTileServerWithCache is NewTileServer with an explicit groupcache
+// configuration. Mount PeerHandler if cfg.Self is set.
+func NewTileServerWithCache(url, basedir string, cfg CacheConfig) (*TileServer, error) {
+	groups.Lock()
+	defer groups.Unlock()
+	return newTileServerWithCache(url, basedir, cfg)
+}
+
+// newTileServerWithCache creates the server and its group. Callers hold
+// groups.
+func newTileServerWithCache(url, basedir string, cfg CacheConfig) (*TileServer, error) {
+	if cfg.GroupName == "" {
+		cfg.GroupName = DefaultCacheConfig.GroupName
+	}
+	if cfg.Size <= 0 {
+		cfg.Size = DefaultCacheConfig.Size
+	}
+	if url != "" {
+		if _, err := ParseURLTemplate(url); err != nil {
+			return nil, err
+		}
+	}
+	if groupcache.GetGroup(cfg.GroupName) != nil {
+		return nil, fmt.Errorf("maptiles: groupcache group %q already exists", cfg.GroupName)
+	}
+	t := newTileServer(url, basedir)
+	if cfg.Self != "" {
+		pool, err := joinPeerPool(cfg)
+		if err != nil {
+			return nil, err
+		}
+		t.pool = pool
+		if len(cfg.Peers) > 0 {
+			setPeers(cfg.Peers)
+		}
+	}
+	t.cache = groupcache.NewGroup(cfg.GroupName, cfg.Size, groupcache.GetterFunc(t.loadTile))
+	if t.pool != nil {
+		peerPool.Lock()
+		if peerPool.servers == nil {
+			peerPool.servers = make(map[string]*TileServer)
+		}
+		peerPool.servers[cfg.GroupName] = t
+		peerPool.Unlock()
+	}
+	return t, nil
+}
+
+func setPeers(peers []string) {
+	peerPool.Lock()
+	defer peerPool.Unlock()
+	peerPool.pool.Set(peers...)
+	peerPool.peers = append([]string(nil), peers...)
+}
+
+// SetPeers replaces the base URLs of the replicas sharing the cache, e.g.
+// when replicas are scaled up or down. As groupcache keeps one peer pool
+// per process, the list applies to all TileServers with peering.
+func (t *TileServer) SetPeers(peers ...string) error {
+	if t.pool == nil {
+		return fmt.Errorf("maptiles: tile server without groupcache peering")
+	}
+	setPeers(peers)
+	return nil
+}
+
+// PeerHandler answers the requests of the other replicas for tiles this
+// one owns. Mount it at CacheConfig.BasePath, by default
+//
+//	http.Handle("/_groupcache/", t.PeerHandler())
+//
+// It is nil without peering. Besides tiles it answers the expiries of the
+// other replicas, see Expire. Only the replicas may reach it: anyone else
+// could read the cached tiles and, unless CacheConfig.Secret is set, purge
+// the LayerStores.
+func (t *TileServer) PeerHandler() http.Handler {
+	if t.pool == nil {
+		return nil
+	}
+	return http.HandlerFunc(servePeer)
+}
+
+// expirePath returns where the peers receive the expiries of a group,
+// below the base path of the pool. Callers hold peerPool.
+func expirePath(group string) string {
+	basePath := peerPool.basePath
+	if basePath == "" {
+		basePath = "/_groupcache/"
+	}
+	return basePath + "_expire/" + group
+}
+
+// peerExpiry is what Expire sends to the peers, first to purge their
+// stores, then to set the generations of the expired tiles.
+type peerExpiry struct {
+	Layer      string
+	Ranges     []TileRange
+	Generation uint64 // 0 to purge the stores
+}
+
+// How long Expire waits for the peers.
+const peerExpiryTimeout = time.Minute
+
+// tellPeers sends the expiry to all peers but this replica.
+func (t *TileServer) tellPeers(ctx context.Context, e peerExpiry) error {
+	if t.pool == nil {
+		return nil
+	}
+	peerPool.Lock()
+	peers, self, secret := peerPool.peers, peerPool.self, peerPool.secret
+	path := expirePath(url.PathEscape(t.cache.Name()))
+	peerPool.Unlock()
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, peerExpiryTimeout)
+	defer cancel()
+	errs := make(chan error, len(peers))
+	n := 0
+	for _, peer := range peers {
+		if peer == self {
+			continue
+		}
+		n++
+		go func(peer string) {
+			req, err := http.NewRequestWithContext(ctx, "POST", peer+path, bytes.NewReader(body))
+			if err != nil {
+				errs <- err
+				return
+			}
+			req.Header.Set("Content-Type", "application/json")
+			if secret != "" {
+				req.Header.Set("Authorization", "Bearer "+secret)
+			}
+			res, err := http.DefaultClient.Do(req)
+			if err == nil {
+				io.Copy(ioutil.Discard, res.Body)
+				res.Body.Close()
+				if res.StatusCode != http.StatusOK {
+					err = fmt.Errorf("maptiles: expiry sent to peer %s: %s", peer, res.Status)
+				}
+			}
+			errs <- err
+		}(peer)
+	}
+	var first error
+	for ; n > 0; n-- {
+		if err := <-errs; err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// servePeer answers the expiries sent by tellPeers and passes all other
+// requests to the groupcache pool.
+func servePeer(w http.ResponseWriter, r *http.Request) {
+	peerPool.Lock()
+	prefix := expirePath("")
+	pool, t := peerPool.pool, peerPool.servers[strings.TrimPrefix(r.URL.Path, prefix)]
+	secret := peerPool.secret
+	peerPool.Unlock()
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		pool.ServeHTTP(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if secret != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+secret)) != 1 {
+		http.Error(w, "403 Forbidden", http.StatusForbidden)
+		return
+	}
+	if t == nil {
+		http.Error(w, "404 Not Found: no such group", http.StatusNotFound)
+		return
+	}
+	var e peerExpiry
+	if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+		http.Error(w, "400 Bad Request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if e.Generation != 0 {
+		t.setGenerations(e.Layer, e.Ranges, e.Generation)
+		fmt.Fprintln(w, 0)
+		return
+	}
+	n, err := t.purge(r.Context(), t.LayerStore(e.Layer), e.Layer, e.Ranges)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, n)
+}
+
+// CacheStats returns the counters of the in-memory tile cache.
+func (t *TileServer) CacheStats() groupcache.Stats {
+	return t.cache.Stats
+}
+
+// cacheKey is the groupcache key of the tile c,
+// "z/x/y:scale:format:generation:layer" with the XYZ row. groupcache
+// cannot remove keys, so Expire changes the generation of the expired
+// tiles instead, see genBucket. For a layer with a CachePolicy MaxAge the
+// generation also changes every MaxAge, so that tiles refreshed in the
+// store are picked up. The layer comes last as its name may contain
+// colons.
+func (t *TileServer) cacheKey(c TileCoord) string {
+	c.setTMS(false)
+	t.mu.Lock()
+	gen := strconv.FormatUint(t.gens[bucketOf(c)], 10)
+	if maxAge := t.policies[c.Layer].MaxAge; maxAge > 0 {
+		gen += "." + strconv.FormatInt(time.Now().UnixNano()/int64(maxAge), 10)
+	}
+	t.mu.Unlock()
+	return fmt.Sprintf("%d/%d/%d:%s:%s:%s:%s", c.Zoom, c.X, c.Y, c.Scale, c.Format, gen, c.Layer)
+}
+
+// Tiles up to genZoom have a generation of their own, deeper tiles share
+// that of their ancestor at genZoom. This bounds the generations kept per
+// layer while an expiry changes the cache keys of few other tiles.
+const genZoom = 6
+
+// genBucket is a set of tiles sharing a generation, see genZoom.
+type genBucket struct {
+	layer   string
+	z, x, y uint64
+}
+
+// bucketOf returns the genBucket of the tile c, which uses XYZ rows.
+func bucketOf(c TileCoord) genBucket {
+	if c.Zoom > genZoom {
+		d := c.Zoom - genZoom
+		return genBucket{c.Layer, genZoom, c.X >> d, c.Y >> d}
+	}
+	return genBucket{c.Layer, c.Zoom, c.X, c.Y}
+}
+
+// setGenerations moves the tiles of the layer in the ranges to generation
+// gen, or to the next one if their generation is not lower.
+func (t *TileServer) setGenerations(layer string, ranges []TileRange, gen uint64) {
+	buckets := make(map[genBucket]bool)
+	for _, r := range ranges {
+		z, d := r.Zoom, uint64(0)
+		if z > genZoom {
+			z, d = genZoom, z-genZoom
+		}
+		for x := r.MinX >> d; x <= r.MaxX>>d; x++ {
+			for y := r.MinY >> d; y <= r.MaxY>>d; y++ {
+				buckets[genBucket{layer, z, x, y}] = true
+			}
+		}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for b := range buckets {
+		if cur := t.gens[b]; gen <= cur {
+			t.gens[b] = cur + 1
+		} else {
+			t.gens[b] = gen
+		}
+	}
+}
+
+// stampTile prefixes the tile with its timestamp, as 8 bytes of big endian
+// Unix time or 0 if unknown, for the groupcache.
+func stampTile(blob []byte, stamp time.Time) []byte {
+	data := make([]byte, 8+len(blob))
+	if !stamp.IsZero() {
+		binary.BigEndian.PutUint64(data, uint64(stamp.Unix()))
+	}
+	copy(data[8:], blob)
+	return data
+}
+
+// unstampTile splits a groupcache value into tile and timestamp.
+func unstampTile(data []byte) ([]byte, time.Time) {
+	if len(data) < 8 {
+		return nil, time.Time{}
+	}
+	var stamp time.Time
+	if sec := binary.BigEndian.Uint64(data); sec != 0 {
+		stamp = time.Unix(int64(sec), 0)
+	}
+	return data[8:], stamp
+}
+
+// loadTile is the groupcache getter, reading the tile and its timestamp
+// from the layer's TileStore. Missing tiles are reported as ErrTileNotFound, so that they
+// don't take up cache space.
+func (t *TileServer) loadTile(ctx groupcache.Context, key string, dest groupcache.Sink) error {
+	var c TileCoord
+	params := strings.SplitN(key, ":", 5)
+	if len(params) != 5 {
+		return fmt.Errorf("maptiles: invalid cache key %q", key)
+	}
+	if _, err := fmt.Sscanf(params[0], "%d/%d/%d", &c.Zoom, &c.X, &c.Y); err != nil {
+		return fmt.Errorf("maptiles: invalid cache key %q", key)
+	}
+	c.Scale, c.Format, c.Layer = params[1], params[2], params[4]
+	blob, stamp, err := getStamped(ctx, t.LayerStore(c.Layer), c)
+	if err != nil {
+		return err
+	}
+	return dest.SetBytes(stampTile(blob, stamp))
+}
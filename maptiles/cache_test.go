@@ -0,0 +1,159 @@
+package maptiles
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync"
+	"testing"
+)
+
+// TestCachePeers test several tile servers per process, serving the
+// groupcache peer requests and sending expiries to the peers.
+func TestCachePeers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tilecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a, err := NewTileServer("", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewTileServer("", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.cache.Name() == b.cache.Name() {
+		t.Errorf("group names: both %q", a.cache.Name())
+	}
+	// Concurrent servers race for the same group names
+	errs := make(chan error, 4)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			_, err := NewTileServer("", dir)
+			errs <- err
+		}()
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("NewTileServer: %v", err)
+		}
+	}
+	if _, err := NewTileServerWithCache("", dir, CacheConfig{GroupName: a.cache.Name()}); err == nil {
+		t.Error("NewTileServerWithCache: duplicate group name accepted")
+	}
+	if a.PeerHandler() != nil || a.SetPeers("http://localhost") == nil {
+		t.Error("tile server without peering has a peer pool")
+	}
+
+	if peerPool.pool != nil {
+		t.Skip("groupcache peer pool created by an earlier run")
+	}
+	mux := http.NewServeMux()
+	ts := httptest.NewUnstartedServer(mux)
+	self := "http://" + ts.Listener.Addr().String()
+	p, err := NewTileServerWithCache("", dir, CacheConfig{GroupName: "peered", Self: self, Peers: []string{self}, Secret: "s3cret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.Handle("/_groupcache/", p.PeerHandler())
+	ts.Start()
+	defer ts.Close()
+
+	c := TileCoord{Layer: "osm", Format: "png"}
+	p.SetLayerStore("osm", NewMemoryStore(1<<20))
+	if err := p.LayerStore("osm").Put(context.Background(), c, []byte("png")); err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.Get(self + "/_groupcache/peered/" + url.PathEscape(p.cacheKey(c)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != 200 || !bytes.Contains(body, []byte("png")) {
+		t.Errorf("peer request: got %d %q; want %d with the tile", res.StatusCode, body, 200)
+	}
+
+	// Expiries are sent to the peers, which purge their stores first
+	var mu sync.Mutex
+	var expiries []peerExpiry
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e peerExpiry
+		json.NewDecoder(r.Body).Decode(&e)
+		if r.URL.Path != "/_groupcache/_expire/peered" {
+			t.Errorf("peer expiry: got path %q", r.URL.Path)
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer s3cret" {
+			t.Errorf("peer expiry: got Authorization %q", got)
+		}
+		mu.Lock()
+		expiries = append(expiries, e)
+		mu.Unlock()
+	}))
+	defer peer.Close()
+	if err := p.SetPeers(self, peer.URL); err != nil {
+		t.Fatal(err)
+	}
+	ranges := []TileRange{{Zoom: 0}}
+	key := p.cacheKey(c)
+	if n, err := p.Expire(context.Background(), "osm", ranges); err != nil || n != 1 {
+		t.Errorf("Expire: got %d, %v; want 1", n, err)
+	}
+	mu.Lock()
+	sent := expiries
+	mu.Unlock()
+	if len(sent) != 2 || sent[0].Generation != 0 || sent[1].Generation == 0 || sent[1].Layer != "osm" {
+		t.Errorf("peer expiries: got %+v; want a purge and a generation", sent)
+	}
+	if p.cacheKey(c) == key {
+		t.Error("Expire: cache key unchanged")
+	}
+
+	// and receive those of the others
+	p.LayerStore("osm").Put(context.Background(), c, []byte("png"))
+	post := func(e peerExpiry, secret string, want int) string {
+		body, _ := json.Marshal(e)
+		req, err := http.NewRequest("POST", self+"/_groupcache/_expire/peered", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+secret)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, _ := ioutil.ReadAll(res.Body)
+		if res.StatusCode != want {
+			t.Errorf("peer expiry: got %d %q; want %d", res.StatusCode, b, want)
+		}
+		return string(bytes.TrimSpace(b))
+	}
+	post(peerExpiry{Layer: "osm", Ranges: ranges}, "guessed", http.StatusForbidden)
+	if n := post(peerExpiry{Layer: "osm", Ranges: ranges}, "s3cret", 200); n != "1" {
+		t.Errorf("peer purge: got %q tiles; want 1", n)
+	}
+	key = p.cacheKey(c)
+	post(peerExpiry{Layer: "osm", Ranges: ranges, Generation: 1}, "s3cret", 200)
+	if p.cacheKey(c) == key {
+		t.Error("peer expiry: cache key unchanged")
+	}
+
+	if err := p.SetPeers(self, "http://127.0.0.1:1"); err != nil {
+		t.Error(err)
+	}
+	if _, err := p.Expire(context.Background(), "osm", ranges); err == nil {
+		t.Error("Expire: unreachable peer not reported")
+	}
+	if _, err := NewTileServerWithCache("", dir, CacheConfig{GroupName: "peered-2", Self: "http://other:8080"}); err == nil {
+		t.Error("NewTileServerWithCache: second peer pool accepted")
+	}
+}
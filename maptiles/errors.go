@@ -0,0 +1,62 @@
+package maptiles
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+var (
+	// The source has no tile for the coordinate.
+	ErrTileNotFound = errors.New("maptiles: tile not found")
+	// The upstream tile server did not answer in time.
+	ErrUpstreamTimeout = errors.New("maptiles: upstream timeout")
+	// The coordinate does not denote a tile, e.g. x >= 2^zoom.
+	ErrInvalidCoord = errors.New("maptiles: invalid tile coordinate")
+)
+
+// UpstreamError reports a broken upstream tile server, either an HTTP
+// 5xx or 429 response, a failed connection (StatusCode 0), a 4xx response
+// other than 404 and 410 or a WMS service exception.
+type UpstreamError struct {
+	URL        string
+	StatusCode int
+	Err        error
+	RetryAfter time.Duration // as requested by the Retry-After header
+}
+
+func (e *UpstreamError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("maptiles: upstream %s: %v", e.URL, e.Err)
+	}
+	return fmt.Sprintf("maptiles: upstream %s: status %d", e.URL, e.StatusCode)
+}
+
+// temporary reports whether asking again may help.
+func (e *UpstreamError) temporary() bool {
+	return e.StatusCode == 0 || e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+func (e *UpstreamError) Unwrap() error {
+	return e.Err
+}
+
+// httpStatus maps errors of the fetch pipeline to the status code the
+// TileServer responds with.
+func httpStatus(err error) int {
+	var upstream *UpstreamError
+	var unknown UnknownLayerError
+	switch {
+	case errors.Is(err, ErrTileNotFound), errors.As(err, &unknown):
+		return http.StatusNotFound
+	case errors.Is(err, ErrInvalidCoord):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrUpstreamTimeout), errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.As(err, &upstream):
+		return http.StatusBadGateway
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,32 @@
+package maptiles
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// TestHttpStatus test pipeline errors map to distinct status codes.
+func TestHttpStatus(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{ErrTileNotFound, 404},
+		{UnknownLayerError{"street"}, 404},
+		{ErrInvalidCoord, 400},
+		{&UpstreamError{URL: "http://upstream", StatusCode: 503}, 502},
+		{&UpstreamError{URL: "http://upstream", StatusCode: 403}, 502},
+		{&UpstreamError{URL: "http://upstream", Err: errors.New("connection refused")}, 502},
+		{ErrUpstreamTimeout, 504},
+		{context.DeadlineExceeded, 504},
+		{fmt.Errorf("render: %w", ErrTileNotFound), 404},
+		{errors.New("mapnik: boom"), 500},
+	}
+	for _, test := range tests {
+		if got := httpStatus(test.err); got != test.want {
+			t.Errorf("httpStatus(%v): got %d; want %d", test.err, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,345 @@
+package maptiles
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TileRange is the block of tiles MinX to MaxX and MinY to MaxY at Zoom,
+// bounds included. Rows are numbered as in XYZ.
+type TileRange struct {
+	Zoom       uint64
+	MinX, MinY uint64
+	MaxX, MaxY uint64
+}
+
+// Size returns the number of tiles in r.
+func (r TileRange) Size() uint64 {
+	return (r.MaxX - r.MinX + 1) * (r.MaxY - r.MinY + 1)
+}
+
+// contains reports whether the tile c lies in r.
+func (r TileRange) contains(c TileCoord) bool {
+	c.setTMS(false)
+	return c.Zoom == r.Zoom && c.X >= r.MinX && c.X <= r.MaxX && c.Y >= r.MinY && c.Y <= r.MaxY
+}
+
+// rangesByZoom groups the ranges by their zoom level.
+func rangesByZoom(ranges []TileRange) map[uint64][]TileRange {
+	zooms := make(map[uint64][]TileRange)
+	for _, r := range ranges {
+		zooms[r.Zoom] = append(zooms[r.Zoom], r)
+	}
+	return zooms
+}
+
+// tiles calls f for each tile of r until f returns false.
+func (r TileRange) tiles(f func(c TileCoord) bool) {
+	for x := r.MinX; x <= r.MaxX; x++ {
+		for y := r.MinY; y <= r.MaxY; y++ {
+			if !f(TileCoord{X: x, Y: y, Zoom: r.Zoom}) {
+				return
+			}
+		}
+	}
+}
+
+// MaxExpiryRanges bounds the tiles listed and the ranges returned by
+// ReadExpiryList.
+var MaxExpiryRanges = 1 << 20
+
+// Highest zoom level expired by ExpireHandler for layers without a zoom
+// range in their LayerInfo.
+var DefaultExpireMaxZoom uint64 = 18
+
+// ReadExpiryList parses a list of dirty tiles as written by osm2pgsql
+// --expire-tiles, one z/x/y per line, and expands each tile to its
+// ancestors and descendants from minZoom up to maxZoom. The result holds
+// one range per zoom level and listed tile, without duplicates: ancestors
+// are single tiles, descendants a block that doubles in size per zoom
+// level. Tiles below a listed tile are covered by that tile's ranges.
+func ReadExpiryList(r io.Reader, minZoom, maxZoom uint64) ([]TileRange, error) {
+	if maxZoom >= uint64(len(gp.Ac)) {
+		return nil, fmt.Errorf("maptiles: expiry max zoom %d out of range", maxZoom)
+	}
+	if minZoom > maxZoom {
+		return nil, fmt.Errorf("maptiles: expiry min zoom %d above max zoom %d", minZoom, maxZoom)
+	}
+	type tile struct{ z, x, y uint64 }
+	var listed []tile
+	seen := make(map[tile]bool)
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var c TileCoord
+		parts := strings.Split(line, "/")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("maptiles: expiry list line %d: %q is not z/x/y", n, line)
+		}
+		for i, v := range []*uint64{&c.Zoom, &c.X, &c.Y} {
+			var err error
+			if *v, err = strconv.ParseUint(parts[i], 10, 64); err != nil {
+				return nil, fmt.Errorf("maptiles: expiry list line %d: %q is not z/x/y", n, line)
+			}
+		}
+		if !c.valid() {
+			return nil, fmt.Errorf("maptiles: expiry list line %d: %w", n, ErrInvalidCoord)
+		}
+		if t := (tile{c.Zoom, c.X, c.Y}); !seen[t] {
+			if len(listed) >= MaxExpiryRanges {
+				return nil, fmt.Errorf("maptiles: expiry list of more than %d tiles", MaxExpiryRanges)
+			}
+			seen[t] = true
+			listed = append(listed, t)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	// covered reports whether an ancestor of t is listed, whose ranges
+	// contain all of t's
+	covered := func(t tile) bool {
+		for t.z > 0 {
+			t = tile{t.z - 1, t.x / 2, t.y / 2}
+			if seen[t] {
+				return true
+			}
+		}
+		return false
+	}
+	var ranges []TileRange
+	added := make(map[tile]bool) // ancestors
+	add := func(r TileRange) error {
+		if len(ranges) >= MaxExpiryRanges {
+			return fmt.Errorf("maptiles: expiry list expands to more than %d tile ranges", MaxExpiryRanges)
+		}
+		ranges = append(ranges, r)
+		return nil
+	}
+	for _, t := range listed {
+		if covered(t) {
+			continue
+		}
+		// Ancestors, shared with other listed tiles
+		for p := t; p.z > minZoom; {
+			p = tile{p.z - 1, p.x / 2, p.y / 2}
+			if p.z <= maxZoom && !added[p] {
+				added[p] = true
+				if err := add(TileRange{p.z, p.x, p.y, p.x, p.y}); err != nil {
+					return nil, err
+				}
+			}
+		}
+		// The tile and its descendants
+		for z := t.z; z <= maxZoom; z++ {
+			if z < minZoom {
+				continue
+			}
+			d := z - t.z
+			r := TileRange{z, t.x << d, t.y << d, (t.x+1)<<d - 1, (t.y+1)<<d - 1}
+			if err := add(r); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return ranges, nil
+}
+
+// PurgeRanges removes the tiles of a layer in the ranges, including
+// queued inserts, and garbage-collects their blobs. It returns the number
+// of tiles removed.
+func (m *TileDb) PurgeRanges(ctx context.Context, layer string, ranges []TileRange) (int64, error) {
+	if err := m.Flush(); err != nil {
+		return 0, err
+	}
+	id, ok := m.layerId(layer)
+	if !ok {
+		return 0, nil
+	}
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	stmt, err := tx.PrepareContext(ctx, "DELETE FROM layered_tiles WHERE layer_id=? AND zoom_level=? AND tile_column BETWEEN ? AND ? AND tile_row BETWEEN ? AND ?")
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	defer stmt.Close()
+	var n int64
+	for _, r := range ranges {
+		// TMS rows grow northwards
+		max := uint64(1)<<r.Zoom - 1
+		res, err := stmt.ExecContext(ctx, id, r.Zoom, r.MinX, r.MaxX, max-r.MaxY, max-r.MinY)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		rows, _ := res.RowsAffected()
+		n += rows
+	}
+	if _, err := tx.ExecContext(ctx, gcQuery); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+// Expire removes the tiles in the ranges from the LayerStore of the layer
+// for all scales and formats and drops them from the in-memory cache. It
+// returns the number of tiles removed from the store, for a TieredStore
+// the largest number removed from one of its tiers.
+//
+// With groupcache peering the other replicas purge their LayerStores as
+// well, all of them before any drops the tiles from its in-memory cache,
+// so that no replica caches an expired tile again. Expire reports peers
+// that failed after expiring the tiles here. The generations of the cache
+// keys are not persisted: a replica restarted after an expiry may get
+// expired tiles its peers still cache, until they are evicted or the
+// MaxAge of the layer's CachePolicy passes.
+//
+// Stores that are no RangePurger get a Delete of each tile for each scale
+// and format this server stored in them since it started. Expire fails
+// instead of sending more than maxExpireDeletes of those.
+func (t *TileServer) Expire(ctx context.Context, layer string, ranges []TileRange) (int64, error) {
+	n, err := t.purge(ctx, t.LayerStore(layer), layer, ranges)
+	if err != nil {
+		return n, err
+	}
+	err = t.tellPeers(ctx, peerExpiry{Layer: layer, Ranges: ranges})
+	gen := uint64(time.Now().UnixNano())
+	t.setGenerations(layer, ranges, gen)
+	if perr := t.tellPeers(ctx, peerExpiry{layer, ranges, gen}); err == nil {
+		err = perr
+	}
+	return n, err
+}
+
+// purge removes the tiles of the layer in the ranges from s, see Expire.
+func (t *TileServer) purge(ctx context.Context, s TileStore, layer string, ranges []TileRange) (int64, error) {
+	switch s := s.(type) {
+	case TieredStore:
+		// The tiers hold copies of the same tiles
+		var max int64
+		for _, tier := range s {
+			n, err := t.purge(ctx, tier, layer, ranges)
+			if err != nil {
+				return max, err
+			}
+			if n > max {
+				max = n
+			}
+		}
+		return max, nil
+	case RangePurger:
+		return s.PurgeRanges(ctx, layer, ranges)
+	}
+	return t.deleteRanges(ctx, s, layer, ranges)
+}
+
+// Bounds the Deletes Expire sends to a store that is no RangePurger.
+const maxExpireDeletes = 1 << 20
+
+// deleteRanges deletes the tiles of the layer in the ranges from s one by
+// one, for each scale and format stored by this server.
+func (t *TileServer) deleteRanges(ctx context.Context, s TileStore, layer string, ranges []TileRange) (int64, error) {
+	t.mu.Lock()
+	var variants []tileVariant
+	for v := range t.variants[layer] {
+		variants = append(variants, v)
+	}
+	t.mu.Unlock()
+	if len(variants) == 0 {
+		return 0, nil
+	}
+	var deletes uint64
+	for _, r := range ranges {
+		if deletes += r.Size() * uint64(len(variants)); deletes > maxExpireDeletes {
+			return 0, fmt.Errorf("maptiles: expiring more than %d tiles of layer %s one by one", maxExpireDeletes, layer)
+		}
+	}
+	var n int64
+	var err error
+	for _, r := range ranges {
+		r.tiles(func(c TileCoord) bool {
+			c.Layer = layer
+			for _, v := range variants {
+				c.Scale, c.Format = v.scale, v.format
+				var ok bool
+				if ok, err = s.Has(ctx, c); ok && err == nil {
+					err = s.Delete(ctx, c)
+					n++
+				}
+				if err != nil {
+					return false
+				}
+			}
+			return true
+		})
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// ExpireHandler accepts expiry lists as body of POST requests, see
+// ReadExpiryList and Expire. The query parameters layer, minzoom and
+// maxzoom select the layer and zoom range, the zoom range defaults to the
+// one of the layer's LayerInfo or 0 to DefaultExpireMaxZoom. The response
+// is the number of tiles removed from cache files. The handler does no
+// authentication, so mount it where only the operators reach it, not next
+// to the tiles.
+func (t *TileServer) ExpireHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		q := r.URL.Query()
+		layer := q.Get("layer")
+		if layer == "" {
+			http.Error(w, "400 Bad Request: layer missing", http.StatusBadRequest)
+			return
+		}
+		minZoom, maxZoom := uint64(0), DefaultExpireMaxZoom
+		if info, ok := t.lmp.LayerInfo(layer); ok && info.MaxZoom != 0 {
+			minZoom, maxZoom = info.MinZoom, info.MaxZoom
+		}
+		var err error
+		if v := q.Get("minzoom"); v != "" {
+			minZoom, err = strconv.ParseUint(v, 10, 64)
+		}
+		if v := q.Get("maxzoom"); v != "" && err == nil {
+			maxZoom, err = strconv.ParseUint(v, 10, 64)
+		}
+		if err != nil {
+			http.Error(w, "400 Bad Request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		ranges, err := ReadExpiryList(r.Body, minZoom, maxZoom)
+		if err != nil {
+			http.Error(w, "400 Bad Request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		n, err := t.Expire(r.Context(), layer, ranges)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintln(w, n)
+	})
+}
@@ -0,0 +1,241 @@
+package maptiles
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestReadExpiryList test parsing osm2pgsql expiry lists and expanding
+// them to tile ranges.
+func TestReadExpiryList(t *testing.T) {
+	size := func(ranges []TileRange) uint64 {
+		var n uint64
+		for _, r := range ranges {
+			n += r.Size()
+		}
+		return n
+	}
+	list := "# dirty tiles\n2/1/2\n\n2/1/3\n2/1/3\n"
+	ranges, err := ReadExpiryList(strings.NewReader(list), 1, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 1 common parent, 2 listed tiles and their children
+	want := []TileRange{
+		{Zoom: 1, MinX: 0, MinY: 1, MaxX: 0, MaxY: 1},
+		{Zoom: 2, MinX: 1, MinY: 2, MaxX: 1, MaxY: 2},
+		{Zoom: 3, MinX: 2, MinY: 4, MaxX: 3, MaxY: 5},
+		{Zoom: 2, MinX: 1, MinY: 3, MaxX: 1, MaxY: 3},
+		{Zoom: 3, MinX: 2, MinY: 6, MaxX: 3, MaxY: 7},
+	}
+	if fmt.Sprint(ranges) != fmt.Sprint(want) || size(ranges) != 1+2+8 {
+		t.Errorf("ranges: got %v; want %v", ranges, want)
+	}
+
+	// Children of listed tiles are covered by their parent
+	ranges, err = ReadExpiryList(strings.NewReader("2/1/1\n1/0/0\n"), 0, 2)
+	if err != nil || len(ranges) != 3 || size(ranges) != 1+1+4 {
+		t.Errorf("nested tiles: got %v, %v; want 3 ranges of 6 tiles", ranges, err)
+	}
+	ranges, err = ReadExpiryList(strings.NewReader("3/4/4\n"), 3, 3)
+	if err != nil || len(ranges) != 1 || size(ranges) != 1 {
+		t.Errorf("single zoom: got %v, %v; want 1 tile", ranges, err)
+	}
+	// The whole world down to zoom 20 is 21 ranges, not 1.4e12 tiles
+	ranges, err = ReadExpiryList(strings.NewReader("0/0/0\n"), 0, 20)
+	if err != nil || len(ranges) != 21 || ranges[20].MaxX != 1<<20-1 {
+		t.Errorf("whole world: got %d ranges, %v; want 21", len(ranges), err)
+	}
+	for _, bad := range []string{"1/2\n", "a/b/c\n", "1/2/0\n"} {
+		if _, err := ReadExpiryList(strings.NewReader(bad), 0, 3); err == nil {
+			t.Errorf("ReadExpiryList(%q): no error", bad)
+		}
+	}
+	for _, zooms := range [][2]uint64{{4, 3}, {0, 40}} {
+		if _, err := ReadExpiryList(strings.NewReader("1/0/0\n"), zooms[0], zooms[1]); err == nil {
+			t.Errorf("ReadExpiryList with zoom range %v: no error", zooms)
+		}
+	}
+	defer func(max int) { MaxExpiryRanges = max }(MaxExpiryRanges)
+	MaxExpiryRanges = 2
+	if _, err := ReadExpiryList(strings.NewReader("3/0/0\n"), 0, 3); err == nil {
+		t.Error("ReadExpiryList: list above MaxExpiryRanges accepted")
+	}
+}
+
+// TestExpire test that expired tiles are fetched again.
+func TestExpire(t *testing.T) {
+	var hits int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Write([]byte("png"))
+	}))
+	defer upstream.Close()
+	dir, err := ioutil.TempDir("", "maptiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := NewTileServer("", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddUpstreamLayer("osm", upstream.URL+"/{z}/{x}/{y}.png"); err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/expire", s.ExpireHandler())
+	mux.Handle("/", s)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	get := func(path string) {
+		res, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != 200 {
+			t.Errorf("%s: got %d; want %d", path, res.StatusCode, 200)
+		}
+	}
+	// Rendered tiles are stored after the response
+	stored := func(c TileCoord) {
+		for i := 0; i < 100; i++ {
+			if ok, _ := s.DbStore().Has(context.Background(), c); ok {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("tile %v not stored", c)
+	}
+	get("/osm/3/2/1.png")
+	stored(TileCoord{X: 2, Y: 1, Zoom: 3, Layer: "osm", Format: "png"})
+	get("/osm/3/2/1.png")
+	get("/osm/3/5/5.png")
+	stored(TileCoord{X: 5, Y: 5, Zoom: 3, Layer: "osm", Format: "png"})
+	if got := atomic.LoadInt32(&hits); got != 2 {
+		t.Fatalf("upstream requests before expiry: got %d; want 2", got)
+	}
+
+	// Expires 3/2/1 through its parent, but not 3/5/5
+	expired, kept := TileCoord{X: 2, Y: 1, Zoom: 3, Layer: "osm", Format: "png"}, TileCoord{X: 5, Y: 5, Zoom: 3, Layer: "osm", Format: "png"}
+	expiredKey, keptKey := s.cacheKey(expired), s.cacheKey(kept)
+	res, err := http.Post(ts.URL+"/expire?layer=osm&minzoom=2&maxzoom=3", "text/plain", strings.NewReader("2/1/0\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != 200 || strings.TrimSpace(string(body)) != "1" {
+		t.Errorf("expire: got %d %q; want %d %q", res.StatusCode, body, 200, "1")
+	}
+	if s.cacheKey(expired) == expiredKey || s.cacheKey(kept) != keptKey {
+		t.Errorf("cache keys after expiry: got %q, %q; want only the first changed from %q, %q",
+			s.cacheKey(expired), s.cacheKey(kept), expiredKey, keptKey)
+	}
+	get("/osm/3/2/1.png")
+	get("/osm/3/5/5.png")
+	if got := atomic.LoadInt32(&hits); got != 3 {
+		t.Errorf("upstream requests after expiry: got %d; want 3", got)
+	}
+
+	res, err = http.Post(ts.URL+"/expire?layer=osm&minzoom=4&maxzoom=3", "text/plain", strings.NewReader("2/1/0\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("expire with minzoom above maxzoom: got %d; want %d", res.StatusCode, http.StatusBadRequest)
+	}
+
+	res, err = http.Get(ts.URL + "/expire?layer=osm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET expire: got %d; want %d", res.StatusCode, http.StatusMethodNotAllowed)
+	}
+}
+
+// TestExpireStores test expiring tiles of all scales and formats from
+// custom layer stores.
+func TestExpireStores(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maptiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := NewTileServer("", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	ranges, err := ReadExpiryList(strings.NewReader("2/1/0\n"), 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mem := NewMemoryStore(1 << 20)
+	files := &FileStore{Dir: filepath.Join(dir, "files")}
+	s.SetLayerStore("osm", TieredStore{mem, files, s.DbStore()})
+	expired := TileCoord{X: 2, Y: 1, Zoom: 3, Layer: "osm", Format: "png"}
+	retina := expired
+	retina.Scale = "@2x"
+	kept := TileCoord{X: 5, Y: 5, Zoom: 3, Layer: "osm", Format: "png"}
+	for _, c := range []TileCoord{expired, retina, kept} {
+		if err := s.LayerStore("osm").Put(ctx, c, []byte("png")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n, err := s.Expire(ctx, "osm", ranges)
+	if err != nil || n != 2 {
+		t.Errorf("Expire: got %d, %v; want 2", n, err)
+	}
+	for name, tier := range map[string]TileStore{"MemoryStore": mem, "FileStore": files, "DbStore": s.DbStore()} {
+		for _, c := range []TileCoord{expired, retina} {
+			if ok, _ := tier.Has(ctx, c); ok {
+				t.Errorf("%s: expired tile %v kept", name, c)
+			}
+		}
+		if ok, _ := tier.Has(ctx, kept); !ok {
+			t.Errorf("%s: tile %v expired", name, kept)
+		}
+	}
+
+	// Layers without cache files get none
+	s.SetLayerStore("empty", TieredStore{NewMemoryStore(1 << 20), s.DbStore()})
+	if n, err := s.Expire(ctx, "empty", ranges); err != nil || n != 0 {
+		t.Errorf("Expire of an empty layer: got %d, %v; want 0", n, err)
+	}
+	if fns, _ := filepath.Glob(filepath.Join(dir, "empty*")); len(fns) != 0 {
+		t.Errorf("Expire created cache files %v", fns)
+	}
+
+	// Stores that cannot purge ranges get a Delete per stored variant
+	plain := struct{ TileStore }{NewMemoryStore(1 << 20)}
+	s.SetLayerStore("plain", plain)
+	expired.Layer = "plain"
+	s.addVariant(expired)
+	plain.Put(ctx, expired, []byte("png"))
+	if n, err := s.Expire(ctx, "plain", ranges); err != nil || n != 1 {
+		t.Errorf("Expire without RangePurger: got %d, %v; want 1", n, err)
+	}
+	if ok, _ := plain.Has(ctx, expired); ok {
+		t.Error("Expire without RangePurger: tile kept")
+	}
+	world, _ := ReadExpiryList(strings.NewReader("0/0/0\n"), 0, 18)
+	if _, err := s.Expire(ctx, "plain", world); err == nil {
+		t.Error("Expire without RangePurger: deleted the world tile by tile")
+	}
+}
@@ -0,0 +1,207 @@
+package maptiles
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FileStore keeps tiles as files in a Dir/layer/z/x/y@scale.format tree,
+// which any web server can serve. Rows are numbered as in XYZ.
+type FileStore struct {
+	Dir string
+}
+
+// Path returns the file name of the tile c. Layer, scale and format must
+// not contain path separators or "..", so that the file is inside Dir.
+func (s *FileStore) Path(c TileCoord) (string, error) {
+	c.setTMS(false)
+	layer, format := c.Layer, c.Format
+	if layer == "" {
+		layer = "default"
+	}
+	if format == "" {
+		format = "png"
+	}
+	for _, v := range []string{layer, c.Scale, format} {
+		if err := checkPathElem(v); err != nil {
+			return "", err
+		}
+	}
+	return filepath.Join(s.Dir, layer,
+		strconv.FormatUint(c.Zoom, 10),
+		strconv.FormatUint(c.X, 10),
+		strconv.FormatUint(c.Y, 10)+c.Scale+"."+format), nil
+}
+
+func (s *FileStore) Get(ctx context.Context, c TileCoord) ([]byte, error) {
+	blob, _, err := s.GetStamped(ctx, c)
+	return blob, err
+}
+
+// GetStamped returns the modification time of the file as timestamp.
+func (s *FileStore) GetStamped(ctx context.Context, c TileCoord) ([]byte, time.Time, error) {
+	fn, err := s.Path(c)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	f, err := os.Open(fn)
+	if os.IsNotExist(err) {
+		return nil, time.Time{}, ErrTileNotFound
+	}
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	blob, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return blob, fi.ModTime(), nil
+}
+
+// Put writes the tile to a temporary file first, so that concurrent Gets
+// never see a partial tile.
+func (s *FileStore) Put(ctx context.Context, c TileCoord, blob []byte) error {
+	return s.PutStamped(ctx, c, blob, time.Time{})
+}
+
+// PutStamped is Put that sets the modification time of the file to stamp
+// unless that is the zero time.
+func (s *FileStore) PutStamped(ctx context.Context, c TileCoord, blob []byte, stamp time.Time) error {
+	fn, err := s.Path(c)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		return err
+	}
+	return writeTileFile(fn, blob, stamp)
+}
+
+// checkPathElem fails if v may lead outside the directory it names a file
+// or directory in.
+func checkPathElem(v string) error {
+	if strings.ContainsAny(v, `/\`) || strings.Contains(v, "..") {
+		return fmt.Errorf("maptiles: %q not allowed in a tile path", v)
+	}
+	return nil
+}
+
+// PurgeRanges removes the files of the tiles of the layer in the ranges,
+// for all scales and formats.
+func (s *FileStore) PurgeRanges(ctx context.Context, layer string, ranges []TileRange) (int64, error) {
+	if layer == "" {
+		layer = "default"
+	}
+	if err := checkPathElem(layer); err != nil {
+		return 0, err
+	}
+	var n int64
+	for z, zranges := range rangesByZoom(ranges) {
+		zdir := filepath.Join(s.Dir, layer, strconv.FormatUint(z, 10))
+		columns, err := ioutil.ReadDir(zdir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return n, err
+		}
+		for _, column := range columns {
+			x, err := strconv.ParseUint(column.Name(), 10, 64)
+			if err != nil || !column.IsDir() {
+				continue
+			}
+			files, err := ioutil.ReadDir(filepath.Join(zdir, column.Name()))
+			if err != nil {
+				return n, err
+			}
+			for _, f := range files {
+				// y.format or y@scale.format, temporary files start with a dot
+				name := f.Name()
+				if i := strings.IndexAny(name, "@."); i > 0 {
+					name = name[:i]
+				}
+				y, err := strconv.ParseUint(name, 10, 64)
+				if err != nil {
+					continue
+				}
+				c := TileCoord{X: x, Y: y, Zoom: z}
+				for _, r := range zranges {
+					if !r.contains(c) {
+						continue
+					}
+					err := os.Remove(filepath.Join(zdir, column.Name(), f.Name()))
+					if err == nil {
+						n++
+					} else if !os.IsNotExist(err) {
+						return n, err
+					}
+					break
+				}
+			}
+		}
+	}
+	return n, nil
+}
+
+// writeTileFile replaces the file fn by a temporary file, so that
+// concurrent readers never see a partial tile and hardlinks to the old
+// file keep their content. The modification time is set to stamp unless
+// that is the zero time.
+func writeTileFile(fn string, blob []byte, stamp time.Time) error {
+	f, err := ioutil.TempFile(filepath.Dir(fn), ".tile")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(blob)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err == nil && !stamp.IsZero() {
+		err = os.Chtimes(f.Name(), stamp, stamp)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), fn)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func (s *FileStore) Delete(ctx context.Context, c TileCoord) error {
+	fn, err := s.Path(c)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(fn)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *FileStore) Has(ctx context.Context, c TileCoord) (bool, error) {
+	fn, err := s.Path(c)
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(fn)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
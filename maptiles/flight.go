@@ -0,0 +1,105 @@
+package maptiles
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// renderFlight is a fetch that one or more requests are waiting for.
+type renderFlight struct {
+	key     string
+	done    chan struct{}
+	result  TileFetchResult
+	err     error
+	waiters int // guarded by flightGroup.mu
+	cancel  context.CancelFunc
+}
+
+// flightGroup coalesces concurrent fetches of the same tile, so that a
+// map full of clients asking for the same uncached tile causes a single
+// upstream request and a single insert.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*renderFlight
+
+	fetches   uint64
+	coalesced uint64
+}
+
+// Counters of the fetches a TileServer sent to its renderers.
+type RenderStats struct {
+	Fetches   uint64 // tiles fetched from a renderer
+	Coalesced uint64 // requests that waited for the fetch of another request
+}
+
+// do returns the result of fetch for key, joining a fetch already in
+// flight. The fetch is cancelled once all waiting requests are cancelled.
+// If it succeeds, store is called once with the result after the waiting
+// requests got it. The flight is joinable until store returns.
+func (g *flightGroup) do(ctx context.Context, key string, fetch func(context.Context) (TileFetchResult, error), store func(TileFetchResult)) (TileFetchResult, error) {
+	g.mu.Lock()
+	if g.flights == nil {
+		g.flights = make(map[string]*renderFlight)
+	}
+	f, ok := g.flights[key]
+	if ok {
+		f.waiters++
+		g.mu.Unlock()
+		atomic.AddUint64(&g.coalesced, 1)
+		return g.wait(ctx, f)
+	}
+	// The fetch must outlive the request that started it as long as others
+	// wait for it
+	fctx, cancel := context.WithCancel(context.Background())
+	f = &renderFlight{key: key, done: make(chan struct{}), waiters: 1, cancel: cancel}
+	g.flights[key] = f
+	g.mu.Unlock()
+	atomic.AddUint64(&g.fetches, 1)
+
+	go func() {
+		f.result, f.err = fetch(fctx)
+		close(f.done)
+		cancel()
+		if f.err == nil && store != nil {
+			store(f.result)
+		}
+		// Requests until now join the finished flight rather than miss a
+		// tile not yet in the store
+		g.mu.Lock()
+		g.forget(f)
+		g.mu.Unlock()
+	}()
+	return g.wait(ctx, f)
+}
+
+func (g *flightGroup) wait(ctx context.Context, f *renderFlight) (TileFetchResult, error) {
+	select {
+	case <-f.done:
+		return f.result, f.err
+	case <-ctx.Done():
+		g.mu.Lock()
+		f.waiters--
+		if f.waiters == 0 {
+			// Later requests must not join the cancelled fetch
+			g.forget(f)
+			f.cancel()
+		}
+		g.mu.Unlock()
+		return TileFetchResult{}, ctx.Err()
+	}
+}
+
+// forget removes f from the flights in progress, g.mu must be held.
+func (g *flightGroup) forget(f *renderFlight) {
+	if g.flights[f.key] == f {
+		delete(g.flights, f.key)
+	}
+}
+
+func (g *flightGroup) stats() RenderStats {
+	return RenderStats{
+		Fetches:   atomic.LoadUint64(&g.fetches),
+		Coalesced: atomic.LoadUint64(&g.coalesced),
+	}
+}
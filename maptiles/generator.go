@@ -1,11 +1,14 @@
 package maptiles
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"math"
 	"os"
+	"path/filepath"
 	"runtime"
+	"sync"
 )
 
 type Generator struct {
@@ -15,6 +18,11 @@ type Generator struct {
 	LayerName string
 	Format    string
 	Url       string
+	// Used to fetch tiles from Url, nil means DefaultUpstreamConfig
+	Upstream *UpstreamConfig
+	// If set, the tiles are also unpacked into the directory
+	// TileDir/LayerName, see TileDb.ExportDir
+	Export *TileDirOptions
 }
 
 type Coord struct {
@@ -30,49 +38,21 @@ func ensureDirExists(path string) {
 func (g *Generator) Run(lowLeft, upRight Coord, minZ, maxZ uint64, name string) {
 	runtime.GOMAXPROCS(g.Threads)
 	c := make(chan TileCoord)
-	mc := make(chan int, g.Threads)
 
 	log.Println("Starting job", name)
 
-	ensureDirExists(g.TileDir)
-
-	lmp := NewLayerMultiplex()
+	tdb, lmp, err := g.open()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer tdb.Close()
+	defer lmp.RemoveSource(g.LayerName)
 	layername := g.LayerName
 	url := g.Url
 	format := g.Format
-	fn := fmt.Sprintf("%s/%s_%s.mbtiles", g.TileDir, layername, format)
-	tdb := NewTileDb(fn)
 	total := 0
-	processed := 0
-	lmp.AddRenderer(layername, url)
-	for i := 0; i < g.Threads; i++ {
-		go func(ctc <-chan TileCoord, mc chan int) {
-			for tc := range ctc {
-				ch := make(chan TileFetchResult)
-				tr := TileFetchRequest{tc, ch}
-				tdb.RequestQueue() <- tr
-				result := <-ch
-				processed = processed + 1
-				if result.Blob == nil {
-					// Tile was not provided by DB, so submit the tile request to the renderer
-					lmp.SubmitRequest(tr)
-					result := <-ch
-					if result.Blob == nil {
-						// The tile could not be rendered, now we need to bail out.
-						fmt.Println("Not Found")
-						return
-					}
-					// insert newly rendered tile into cache db
-					tdb.InsertQueue() <- result
-					percent := processed / total * 100
-					fmt.Println("Insert", tc.Zoom, tc.X, tc.Y, "percent, processed/total: ", percent, processed, total)
-				} else {
-					fmt.Println("Cached", tc.Zoom, tc.X, tc.Y)
-				}
-			}
-			mc <- 1
-		}(c, mc)
-	}
+	done := g.work(tdb, lmp, c, &total, false)
 
 	ll0 := [2]float64{lowLeft.X, upRight.Y}
 	ll1 := [2]float64{upRight.X, lowLeft.Y}
@@ -110,7 +90,164 @@ func (g *Generator) Run(lowLeft, upRight Coord, minZ, maxZ uint64, name string)
 		}
 	}
 	close(c)
+	done()
+	if err := g.recordMetadata(tdb, lowLeft, upRight, minZ, maxZ); err != nil {
+		log.Println(err)
+	}
+	if g.Export != nil {
+		opt := *g.Export
+		if opt.Layer == "" {
+			opt.Layer = layername
+		}
+		n, err := tdb.ExportDir(filepath.Join(g.TileDir, layername), opt)
+		if err != nil {
+			log.Println(err)
+		}
+		log.Println("Exported", n, "tiles of job", name)
+	}
+}
+
+// RenderTiles renders the tiles in the ranges again and replaces them in
+// the cache db, e.g. after they were expired, see ReadExpiryList. Layer,
+// Url and Format of the tiles are those of the Generator.
+func (g *Generator) RenderTiles(ranges []TileRange, name string) error {
+	runtime.GOMAXPROCS(g.Threads)
+	log.Println("Starting job", name)
+
+	tdb, lmp, err := g.open()
+	if err != nil {
+		return err
+	}
+	defer tdb.Close()
+	defer lmp.RemoveSource(g.LayerName)
+	c := make(chan TileCoord)
+	total := 0
+	for _, r := range ranges {
+		total += int(r.Size())
+	}
+	done := g.work(tdb, lmp, c, &total, true)
+	for _, r := range ranges {
+		r.tiles(func(tc TileCoord) bool {
+			tc.Layer, tc.Url, tc.Format = g.LayerName, g.Url, g.Format
+			c <- tc
+			return true
+		})
+	}
+	close(c)
+	return done()
+}
+
+// open returns the cache db of the Generator and the renderer of its
+// layer. The caller closes the db.
+func (g *Generator) open() (*TileDb, *LayerMultiplex, error) {
+	ensureDirExists(g.TileDir)
+
+	lmp := NewLayerMultiplex()
+	fn := fmt.Sprintf("%s/%s_%s.mbtiles", g.TileDir, g.LayerName, g.Format)
+	tdb := NewTileDb(fn)
+	if tdb == nil {
+		return nil, nil, fmt.Errorf("maptiles: cannot open cache db %s", fn)
+	}
+	if err := tdb.SetDefaultLayer(g.LayerName); err != nil {
+		log.Println(err)
+	}
+	if g.Url == "" && g.MapFile != "" {
+		// No upstream tile server given, so render the stylesheet ourselves
+		mp, err := NewMapnikPool(g.MapFile, g.Threads)
+		if err != nil {
+			tdb.Close()
+			return nil, nil, fmt.Errorf("maptiles: error loading stylesheet: %v", err)
+		}
+		lmp.AddTileRenderer(g.LayerName, mp)
+	} else {
+		if _, err := ParseURLTemplate(g.Url); err != nil {
+			tdb.Close()
+			return nil, nil, err
+		}
+		lmp.AddTileRenderer(g.LayerName, NewUpstreamRenderer(g.Url, g.Upstream))
+	}
+	return tdb, lmp, nil
+}
+
+// work starts Threads workers rendering the tiles received from c into
+// tdb. Tiles already in tdb are skipped unless force is set. The returned
+// function waits for the workers after c was closed and commits the
+// rendered tiles.
+func (g *Generator) work(tdb *TileDb, lmp *LayerMultiplex, c <-chan TileCoord, total *int, force bool) func() error {
+	ctx := context.Background()
+	mc := make(chan int, g.Threads)
+	var mu sync.Mutex
+	processed := 0
 	for i := 0; i < g.Threads; i++ {
-		<-mc
+		go func(ctc <-chan TileCoord, mc chan int) {
+			defer func() { mc <- 1 }()
+			for tc := range ctc {
+				var blob []byte
+				if !force {
+					blob, _ = tdb.FetchTile(ctx, tc)
+				}
+				mu.Lock()
+				processed = processed + 1
+				n := processed
+				mu.Unlock()
+				if blob == nil {
+					// Tile was not provided by DB, so submit the tile request to the renderer
+					result, err := lmp.FetchTile(ctx, tc)
+					if err != nil {
+						log.Println(err)
+						continue
+					}
+					if result.Blob == nil {
+						fmt.Println("Not Found")
+						continue
+					}
+					// insert newly rendered tile into cache db
+					result.Blob = canonicalTile(tc.Format, result.Blob)
+					tdb.InsertQueue() <- result
+					percent := n * 100 / *total
+					fmt.Println("Insert", tc.Zoom, tc.X, tc.Y, "percent, processed/total: ", percent, n, *total)
+				} else {
+					fmt.Println("Cached", tc.Zoom, tc.X, tc.Y)
+				}
+			}
+		}(c, mc)
+	}
+	return func() error {
+		for i := 0; i < g.Threads; i++ {
+			<-mc
+		}
+		return tdb.Flush()
+	}
+}
+
+// recordMetadata extends the zoom range and bounds in the metadata of tdb
+// by the area seeded by a job.
+func (g *Generator) recordMetadata(tdb *TileDb, lowLeft, upRight Coord, minZ, maxZ uint64) error {
+	md, err := tdb.ReadMetadata()
+	if err != nil {
+		return err
+	}
+	bounds := [4]float64{lowLeft.X, lowLeft.Y, upRight.X, upRight.Y}
+	if md.MaxZoom != 0 {
+		if md.MinZoom < minZ {
+			minZ = md.MinZoom
+		}
+		if md.MaxZoom > maxZ {
+			maxZ = md.MaxZoom
+		}
+	}
+	if md.Bounds != [4]float64{} {
+		bounds = [4]float64{
+			math.Min(bounds[0], md.Bounds[0]), math.Min(bounds[1], md.Bounds[1]),
+			math.Max(bounds[2], md.Bounds[2]), math.Max(bounds[3], md.Bounds[3]),
+		}
 	}
+	return tdb.WriteMetadata(&MBTilesMetadata{
+		Name:    g.LayerName,
+		Format:  mbtilesFormat(g.Format),
+		Bounds:  bounds,
+		Center:  [3]float64{(bounds[0] + bounds[2]) / 2, (bounds[1] + bounds[3]) / 2, float64(minZ)},
+		MinZoom: minZ,
+		MaxZoom: maxZ,
+	})
 }
@@ -59,3 +59,25 @@ func fromPixelToLL(px [2]float64, zoom uint64) [2]float64 {
 	h := 180.0 / math.Pi * (2*math.Atan(math.Exp(g)) - 0.5*math.Pi)
 	return [2]float64{f, h}
 }
+
+// Half the circumference of the earth in EPSG:3857 meters
+const originShift = math.Pi * 6378137
+
+func fromPixelToMerc(px [2]float64, zoom uint64) [2]float64 {
+	res := 2 * originShift / gp.Ac[zoom]
+	return [2]float64{px[0]*res - originShift, originShift - px[1]*res}
+}
+
+// Bounds of a Google tile in EPSG:3857 as minx, miny, maxx, maxy.
+func tileToMercBBox(zoom, x, y uint64) [4]float64 {
+	p0 := fromPixelToMerc([2]float64{float64(x) * 256, (float64(y) + 1) * 256}, zoom)
+	p1 := fromPixelToMerc([2]float64{(float64(x) + 1) * 256, float64(y) * 256}, zoom)
+	return [4]float64{p0[0], p0[1], p1[0], p1[1]}
+}
+
+// Bounds of a Google tile in degrees as minlon, minlat, maxlon, maxlat.
+func tileToLLBBox(zoom, x, y uint64) [4]float64 {
+	l0 := fromPixelToLL([2]float64{float64(x) * 256, (float64(y) + 1) * 256}, zoom)
+	l1 := fromPixelToLL([2]float64{(float64(x) + 1) * 256, float64(y) * 256}, zoom)
+	return [4]float64{l0[0], l0[1], l1[0], l1[1]}
+}
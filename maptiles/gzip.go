@@ -0,0 +1,107 @@
+package maptiles
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// Vector tiles are stored gzip-compressed, as MBTiles requires, whether
+// the renderer delivered them compressed or not. writeTile sends them in
+// the encoding the client accepts.
+
+// isGzip reports whether blob starts with the gzip magic number.
+func isGzip(blob []byte) bool {
+	return len(blob) >= 2 && blob[0] == 0x1f && blob[1] == 0x8b
+}
+
+// canonicalTile returns the tile in the form it is stored in: vector tiles
+// gzip-compressed, all other formats unchanged.
+func canonicalTile(format string, blob []byte) []byte {
+	if !strings.HasSuffix(format, "pbf") || blob == nil || isGzip(blob) {
+		return blob
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(blob)
+	if err := zw.Close(); err != nil {
+		log.Println(err)
+		return blob
+	}
+	return buf.Bytes()
+}
+
+// encodeTile converts a vector tile to the content coding the client
+// accepts, preferring gzip over deflate over none. It returns the encoded
+// tile and the Content-Encoding, "" for none.
+func encodeTile(blob []byte, acceptEncoding string) ([]byte, string, error) {
+	accepts := acceptedEncodings(acceptEncoding)
+	if isGzip(blob) && accepts["gzip"] {
+		return blob, "gzip", nil
+	}
+	raw := blob
+	if isGzip(blob) {
+		zr, err := gzip.NewReader(bytes.NewReader(blob))
+		if err != nil {
+			return nil, "", err
+		}
+		if raw, err = ioutil.ReadAll(zr); err != nil {
+			return nil, "", err
+		}
+	}
+	switch {
+	case accepts["gzip"]:
+		return canonicalTile("pbf", raw), "gzip", nil
+	case accepts["deflate"]:
+		// HTTP deflate is the zlib format
+		var buf bytes.Buffer
+		zw := zlib.NewWriter(&buf)
+		zw.Write(raw)
+		if err := zw.Close(); err != nil {
+			return nil, "", err
+		}
+		return buf.Bytes(), "deflate", nil
+	}
+	return raw, "", nil
+}
+
+// acceptedEncodings parses an Accept-Encoding header into the content
+// codings with a non-zero quality. "*" stands for gzip and deflate unless
+// they are listed themselves.
+func acceptedEncodings(header string) map[string]bool {
+	accepts := make(map[string]bool)
+	star, hasStar := false, false
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		ok := true
+		for _, p := range params[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				q, err := strconv.ParseFloat(p[2:], 64)
+				ok = err == nil && q > 0
+			}
+		}
+		switch coding {
+		case "":
+		case "*":
+			star, hasStar = ok, true
+		case "x-gzip":
+			accepts["gzip"] = ok
+		default:
+			accepts[coding] = ok
+		}
+	}
+	if hasStar {
+		for _, coding := range []string{"gzip", "deflate"} {
+			if _, listed := accepts[coding]; !listed {
+				accepts[coding] = star
+			}
+		}
+	}
+	return accepts
+}
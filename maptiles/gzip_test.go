@@ -0,0 +1,115 @@
+package maptiles
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestAcceptedEncodings test parsing Accept-Encoding headers.
+func TestAcceptedEncodings(t *testing.T) {
+	for header, want := range map[string][2]bool{
+		"":                     {false, false},
+		"gzip, deflate, br":    {true, true},
+		"deflate;q=0.5":        {false, true},
+		"gzip;q=0, *":          {false, true},
+		"*;q=0":                {false, false},
+		"x-gzip, identity;q=1": {true, false},
+	} {
+		got := acceptedEncodings(header)
+		if got["gzip"] != want[0] || got["deflate"] != want[1] {
+			t.Errorf("acceptedEncodings(%q): got gzip %v, deflate %v; want %v, %v", header, got["gzip"], got["deflate"], want[0], want[1])
+		}
+	}
+}
+
+// TestVectorTileEncoding test storing vector tiles gzip-compressed and
+// serving them in the content coding the client accepts.
+func TestVectorTileEncoding(t *testing.T) {
+	pbf := []byte("\x1a\x05layer")
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(pbf)
+	}))
+	defer upstream.Close()
+	dir, err := ioutil.TempDir("", "maptiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := NewTileServer("", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddUpstreamLayer("roads", upstream.URL+"/{z}/{x}/{y}.pbf"); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	get := func(acceptEncoding string) (*http.Response, []byte) {
+		req, _ := http.NewRequest("GET", ts.URL+"/roads/3/2/1.pbf", nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return res, body
+	}
+	decoders := map[string]func(io.Reader) (io.Reader, error){
+		"gzip":    func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		"deflate": func(r io.Reader) (io.Reader, error) { return zlib.NewReader(r) },
+		"":        func(r io.Reader) (io.Reader, error) { return r, nil },
+	}
+	check := func(acceptEncoding, want string) {
+		res, body := get(acceptEncoding)
+		if got := res.Header.Get("Content-Encoding"); got != want {
+			t.Errorf("Accept-Encoding %q: got Content-Encoding %q; want %q", acceptEncoding, got, want)
+			return
+		}
+		if got := res.Header.Get("Vary"); got != "Accept-Encoding" {
+			t.Errorf("Accept-Encoding %q: got Vary %q; want %q", acceptEncoding, got, "Accept-Encoding")
+		}
+		r, err := decoders[want](bytes.NewReader(body))
+		if err == nil {
+			body, err = ioutil.ReadAll(r)
+		}
+		if err != nil || !bytes.Equal(body, pbf) {
+			t.Errorf("Accept-Encoding %q: got %q, %v; want %q", acceptEncoding, body, err, pbf)
+		}
+	}
+	check("gzip", "gzip")
+
+	c := TileCoord{X: 2, Y: 1, Zoom: 3, Layer: "roads", Format: "vector.pbf"}
+	var blob []byte
+	for i := 0; i < 100 && blob == nil; i++ {
+		// Rendered tiles are stored after the response
+		time.Sleep(10 * time.Millisecond)
+		blob, _ = s.DbStore().Get(context.Background(), c)
+	}
+	if !isGzip(blob) {
+		t.Errorf("stored tile: got %q; want it gzip-compressed", blob)
+	}
+	check("gzip, deflate", "gzip")
+	check("deflate", "deflate")
+	check("identity", "")
+	check("", "")
+
+	// Uncompressed tiles of older cache files
+	if err := s.DbStore().Put(context.Background(), c, pbf); err != nil {
+		t.Fatal(err)
+	}
+	// Drop the compressed tile from the groupcache, see Expire
+	s.setGenerations("roads", []TileRange{{Zoom: 3, MinX: 2, MinY: 1, MaxX: 2, MaxY: 1}}, 1)
+	check("gzip", "gzip")
+	check("", "")
+}
@@ -0,0 +1,143 @@
+package maptiles
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Bounded pool of MapnikRenderers for the same stylesheet. Each renderer
+// is checked out by one goroutine at a time, so up to Size tiles are
+// rendered in parallel.
+type MapnikPool struct {
+	Stylesheet string
+	Size       int
+
+	mu       sync.Mutex // guards isClosed and refills of idle
+	idle     chan *MapnikRenderer
+	closed   chan bool
+	isClosed bool
+
+	renders   uint64
+	waitNanos uint64
+	maxWait   uint64
+}
+
+// Snapshot of the usage counters of a MapnikPool.
+type MapnikPoolStats struct {
+	Size     int
+	Idle     int
+	Renders  uint64        // number of checkouts
+	WaitTime time.Duration // total time spent waiting for a free map
+	MaxWait  time.Duration // longest single wait for a free map
+}
+
+// AvgWait is the mean time a checkout waited for a free map.
+func (s MapnikPoolStats) AvgWait() time.Duration {
+	if s.Renders == 0 {
+		return 0
+	}
+	return s.WaitTime / time.Duration(s.Renders)
+}
+
+// NewMapnikPool loads the stylesheet into size maps. If size is not
+// positive, one map per CPU is created.
+func NewMapnikPool(stylesheet string, size int) (*MapnikPool, error) {
+	if size <= 0 {
+		size = runtime.NumCPU()
+	}
+	p := &MapnikPool{Stylesheet: stylesheet, Size: size}
+	p.idle = make(chan *MapnikRenderer, size)
+	p.closed = make(chan bool)
+	for i := 0; i < size; i++ {
+		r, err := NewMapnikRenderer(stylesheet)
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		p.idle <- r
+	}
+	return p, nil
+}
+
+// Get checks out a renderer, blocking until one is free or ctx is
+// cancelled. It must be handed back with Put.
+func (p *MapnikPool) Get(ctx context.Context) (*MapnikRenderer, error) {
+	start := time.Now()
+	select {
+	case r := <-p.idle:
+		p.recordWait(time.Since(start))
+		return r, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-p.closed:
+		return nil, fmt.Errorf("mapnik: pool is closed")
+	}
+}
+
+// Put returns a renderer checked out with Get.
+func (p *MapnikPool) Put(r *MapnikRenderer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.isClosed {
+		r.Close()
+		return
+	}
+	p.idle <- r
+}
+
+// RenderTile renders c with the next free map of the pool. Requests
+// cancelled while waiting for a map leave the queue.
+func (p *MapnikPool) RenderTile(ctx context.Context, c TileCoord) ([]byte, error) {
+	r, err := p.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer p.Put(r)
+	return r.RenderTile(ctx, c)
+}
+
+func (p *MapnikPool) recordWait(d time.Duration) {
+	atomic.AddUint64(&p.renders, 1)
+	atomic.AddUint64(&p.waitNanos, uint64(d))
+	for {
+		max := atomic.LoadUint64(&p.maxWait)
+		if uint64(d) <= max || atomic.CompareAndSwapUint64(&p.maxWait, max, uint64(d)) {
+			return
+		}
+	}
+}
+
+// Stats returns the current usage counters, e.g. for export via expvar.
+func (p *MapnikPool) Stats() MapnikPoolStats {
+	return MapnikPoolStats{
+		Size:     p.Size,
+		Idle:     len(p.idle),
+		Renders:  atomic.LoadUint64(&p.renders),
+		WaitTime: time.Duration(atomic.LoadUint64(&p.waitNanos)),
+		MaxWait:  time.Duration(atomic.LoadUint64(&p.maxWait)),
+	}
+}
+
+// Close frees all idle maps. Maps that are checked out are freed when
+// they are handed back.
+func (p *MapnikPool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.isClosed {
+		return nil
+	}
+	p.isClosed = true
+	close(p.closed)
+	for {
+		select {
+		case r := <-p.idle:
+			r.Close()
+		default:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package maptiles
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+// TestMapnikPool test concurrent renders never share a map.
+func TestMapnikPool(t *testing.T) {
+	p, err := NewMapnikPool("../sampledata/stylesheet.xml", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	var wg sync.WaitGroup
+	for i := uint64(0); i < 8; i++ {
+		wg.Add(1)
+		go func(x uint64) {
+			defer wg.Done()
+			blob, err := p.RenderTile(context.Background(), TileCoord{X: x, Y: 0, Zoom: 3})
+			if err != nil {
+				t.Error(err)
+			}
+			if len(blob) == 0 {
+				t.Error("empty tile")
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	s := p.Stats()
+	if s.Renders != 8 {
+		t.Errorf("Renders: got %d; want %d", s.Renders, 8)
+	}
+	if s.Idle != 2 {
+		t.Errorf("Idle: got %d; want %d", s.Idle, 2)
+	}
+}
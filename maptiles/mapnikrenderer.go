@@ -0,0 +1,100 @@
+package maptiles
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/fawick/go-mapnik/mapnik"
+)
+
+// Renders a Mapnik stylesheet as Web Mercator tiles.
+type MapnikRenderer struct {
+	mu sync.Mutex // a mapnik.Map must not be used by several goroutines
+	m  *mapnik.Map
+	mp mapnik.Projection
+}
+
+// NewMapnikRenderer loads the Mapnik XML stylesheet. Call Close to free
+// the underlying map when the renderer is no longer used.
+func NewMapnikRenderer(stylesheet string) (*MapnikRenderer, error) {
+	t := new(MapnikRenderer)
+	t.m = mapnik.NewMap(256, 256)
+	if err := t.m.Load(stylesheet); err != nil {
+		t.m.Free()
+		return nil, err
+	}
+	t.mp = t.m.Projection()
+	return t, nil
+}
+
+// RenderTile renders c. Mapnik cannot be interrupted, so ctx is only
+// checked before rendering starts.
+func (t *MapnikRenderer) RenderTile(ctx context.Context, c TileCoord) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if !c.valid() {
+		return nil, ErrInvalidCoord
+	}
+	switch c.Format {
+	case "", "png":
+	default:
+		return nil, fmt.Errorf("mapnik: cannot render format %q", c.Format)
+	}
+	c.setTMS(false)
+	return t.RenderTileZXY(c.Zoom, c.X, c.Y, scaleFactor(c.Scale))
+}
+
+// Render a tile with coordinates in Google tile format.
+// Most upper left tile is always 0,0. The image is 256*scale pixels wide.
+func (t *MapnikRenderer) RenderTileZXY(zoom, x, y uint64, scale uint32) ([]byte, error) {
+	// Calculate pixel positions of bottom left & top right
+	p0 := [2]float64{float64(x) * 256, (float64(y) + 1) * 256}
+	p1 := [2]float64{(float64(x) + 1) * 256, float64(y) * 256}
+
+	// Convert to LatLong(EPSG:4326)
+	l0 := fromPixelToLL(p0, zoom)
+	l1 := fromPixelToLL(p1, zoom)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.m == nil {
+		return nil, fmt.Errorf("mapnik: renderer is closed")
+	}
+
+	// Convert to map projection (e.g. mercator co-ords EPSG:3857)
+	c0 := t.mp.Forward(mapnik.Coord{X: l0[0], Y: l0[1]})
+	c1 := t.mp.Forward(mapnik.Coord{X: l1[0], Y: l1[1]})
+
+	// Bounding box for the Tile
+	t.m.Resize(256*scale, 256*scale)
+	t.m.ZoomToMinMax(c0.X, c0.Y, c1.X, c1.Y)
+	t.m.SetBufferSize(128)
+	return t.m.RenderToMemoryPng()
+}
+
+// Close frees the underlying mapnik.Map.
+func (t *MapnikRenderer) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.m != nil {
+		t.mp.Free()
+		t.m.Free()
+		t.m = nil
+	}
+	return nil
+}
+
+// scaleFactor parses a TileCoord.Scale suffix such as "@2x". Anything
+// else is treated as scale 1.
+func scaleFactor(scale string) uint32 {
+	s := strings.TrimSuffix(strings.TrimPrefix(scale, "@"), "x")
+	f, err := strconv.ParseUint(s, 10, 32)
+	if err != nil || f == 0 {
+		return 1
+	}
+	return uint32(f)
+}
@@ -1,10 +1,15 @@
 package maptiles
 
 import (
+	"context"
 	"crypto/md5"
 	"database/sql"
 	"fmt"
 	"log"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 	//"net/http"
@@ -13,90 +18,330 @@ import (
 
 // MBTiles 1.2-compatible Tile Db with multi-layer support.
 // Was named Mbtiles before, hence the use of *m in methods.
+//
+// The file is kept in WAL mode, so fetches are served in parallel by a
+// pool of read connections and never wait for the single writer, which
+// commits the queued inserts in transactions. See Run.
 type TileDb struct {
-	db          *sql.DB
+	db          *sql.DB // the writer, a single connection
+	rdb         *sql.DB // pool of read-only connections
 	requestChan chan TileFetchRequest
 	insertChan  chan TileFetchResult
+	putChan     chan tileInsert
+	flushChan   chan chan error
+	mu          sync.RWMutex // guards layerIds
 	layerIds    map[string]int
 	qc          chan bool
 	path        string
+	opts        TileDbOptions
+}
+
+// TileDbOptions controls how the writer of a TileDb batches inserts.
+type TileDbOptions struct {
+	// Maximum number of inserts committed in one transaction, values < 1
+	// mean 1
+	BatchSize int
+	// Longest time a queued insert waits for its batch to fill up, 0 means
+	// the batch is committed as soon as the queue runs empty. Flush and
+	// Close commit at once.
+	FlushInterval time.Duration
+}
+
+// Used by NewTileDb.
+var DefaultTileDbOptions = TileDbOptions{
+	BatchSize:     256,
+	FlushInterval: 100 * time.Millisecond,
+}
+
+// Description of new files, it tells nothing about the tiles.
+const defaultDescription = "Compatible with MBTiles spec 1.2."
+
+// execer is implemented by *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
 }
 
 func NewTileDb(path string) *TileDb {
+	return NewTileDbWithOptions(path, DefaultTileDbOptions)
+}
+
+// NewTileDbWithOptions opens or creates the MBTiles file at path.
+func NewTileDbWithOptions(path string, opts TileDbOptions) *TileDb {
 	m := TileDb{}
 	m.path = path
+	if opts.BatchSize < 1 {
+		opts.BatchSize = 1
+	}
+	m.opts = opts
 	var err error
-	m.db, err = sql.Open("sqlite3", path)
+	m.db, err = sql.Open("sqlite3", "file:"+path+"?_journal_mode=WAL&_synchronous=NORMAL&_busy_timeout=5000&_txlock=immediate")
+	if err != nil {
+		log.Println("Error opening db", err.Error())
+		return nil
+	}
+	m.db.SetMaxOpenConns(1)
+	m.rdb, err = sql.Open("sqlite3", "file:"+path+"?_query_only=true&_busy_timeout=5000")
 	if err != nil {
 		log.Println("Error opening db", err.Error())
+		m.db.Close()
 		return nil
 	}
+	m.rdb.SetMaxOpenConns(4 * runtime.NumCPU())
+	m.rdb.SetMaxIdleConns(runtime.NumCPU())
 	queries := []string{
-		"PRAGMA journal_mode = OFF",
 		"CREATE TABLE IF NOT EXISTS layers(layer_name text PRIMARY KEY NOT NULL)",
 		"CREATE TABLE IF NOT EXISTS metadata (name text PRIMARY KEY NOT NULL, value text NOT NULL)",
-		"CREATE TABLE IF NOT EXISTS layered_tiles (layer_id integer, zoom_level integer, tile_column integer, tile_row integer, checksum text, PRIMARY KEY (layer_id, zoom_level, tile_column, tile_row) FOREIGN KEY(checksum) REFERENCES tile_blobs(checksum))",
+		"CREATE TABLE IF NOT EXISTS layered_tiles (layer_id integer, zoom_level integer, tile_column integer, tile_row integer, checksum text, updated_at integer, PRIMARY KEY (layer_id, zoom_level, tile_column, tile_row) FOREIGN KEY(checksum) REFERENCES tile_blobs(checksum))",
 		"CREATE TABLE IF NOT EXISTS tile_blobs (checksum text, tile_data blob)",
-		//! "CREATE VIEW IF NOT EXISTS tiles AS SELECT layered_tiles.zoom_level as zoom_level, layered_tiles.tile_column as tile_column, layered_tiles.tile_row as tile_row, (SELECT tile_data FROM tile_blobs WHERE checksum=layered_tiles.checksum) as tile_data FROM layered_tiles WHERE layered_tiles.layer_id = (SELECT rowid FROM layers WHERE layer_name='default')",
-		"CREATE VIEW IF NOT EXISTS tiles AS SELECT layered_tiles.zoom_level as zoom_level, layered_tiles.tile_column as tile_column, layered_tiles.tile_row as tile_row, (SELECT tile_data FROM tile_blobs WHERE checksum=layered_tiles.checksum) as tile_data FROM layered_tiles WHERE layered_tiles.layer_id = '0'",
-		"REPLACE INTO metadata VALUES('name', 'go-mapnik cache file')",
-		"REPLACE INTO metadata VALUES('type', 'overlay')",
-		"REPLACE INTO metadata VALUES('version', '1')",
-		"REPLACE INTO metadata VALUES('description', 'Compatible with MBTiles spec 1.2.')",
-		"REPLACE INTO metadata VALUES('format', 'png')",
-		// "REPLACE INTO metadata VALUES('bounds', '-180.0,-85,180,85')",
+		// Defaults for new files, see WriteMetadata for the other rows
+		"INSERT OR IGNORE INTO metadata VALUES('type', 'overlay')",
+		"INSERT OR IGNORE INTO metadata VALUES('version', '1')",
+		"INSERT OR IGNORE INTO metadata VALUES('description', '" + defaultDescription + "')",
 		"INSERT OR IGNORE INTO layers(layer_name) VALUES('default')",
+		// The MBTiles 'tiles' view shows the layer whose rowid is stored in
+		// the metadata row 'default_layer_id', see SetDefaultLayer.
+		"INSERT OR IGNORE INTO metadata VALUES('default_layer_id', (SELECT rowid FROM layers WHERE layer_name='default'))",
+		"DROP VIEW IF EXISTS tiles",
+		"CREATE VIEW tiles AS SELECT layered_tiles.zoom_level as zoom_level, layered_tiles.tile_column as tile_column, layered_tiles.tile_row as tile_row, (SELECT tile_data FROM tile_blobs WHERE checksum=layered_tiles.checksum) as tile_data FROM layered_tiles WHERE layered_tiles.layer_id = (SELECT CAST(value AS integer) FROM metadata WHERE name='default_layer_id')",
 	}
 
+	var unstamped int
+	m.db.QueryRow("SELECT count(*) FROM sqlite_master WHERE name='layered_tiles' AND NOT EXISTS (SELECT 1 FROM pragma_table_info('layered_tiles') WHERE name='updated_at')").Scan(&unstamped)
+	if unstamped != 0 {
+		// Unix time the tile was stored, NULL for tiles of older files
+		queries = append(queries, "ALTER TABLE layered_tiles ADD COLUMN updated_at integer")
+	}
+	var legacy int
+	m.db.QueryRow("SELECT count(*) FROM layered_tiles WHERE layer_id=0").Scan(&legacy)
+	if legacy != 0 {
+		// Files written before multi-layer support stored everything as
+		// layer 0. The tiles are kept as layer 'default' until the file
+		// is opened for a layer, see SetDefaultLayer.
+		queries = append(queries,
+			"UPDATE OR IGNORE layered_tiles SET layer_id=(SELECT rowid FROM layers WHERE layer_name='default') WHERE layer_id=0",
+			"REPLACE INTO metadata VALUES('legacy_layer', 'default')")
+	}
+	var indexed int
+	m.db.QueryRow("SELECT count(*) FROM sqlite_master WHERE name='tile_blobs_checksum'").Scan(&indexed)
+	if indexed == 0 {
+		// Blobs are looked up by checksum, and the writer relies on each
+		// checksum being stored once. Files written before the index may
+		// hold duplicates, which would make creating it fail.
+		queries = append(queries,
+			"DELETE FROM tile_blobs WHERE rowid NOT IN (SELECT min(rowid) FROM tile_blobs GROUP BY checksum)",
+			"CREATE UNIQUE INDEX tile_blobs_checksum ON tile_blobs(checksum)")
+	}
 	for _, query := range queries {
 		_, err = m.db.Exec(query)
 		if err != nil {
 			log.Println("Error setting up db", err.Error())
+			m.db.Close()
+			m.rdb.Close()
 			return nil
 		}
 	}
 
-	m.readLayers()
+	if err = m.readLayers(); err != nil {
+		log.Println("Error fetching layer definitions", err.Error())
+		m.db.Close()
+		m.rdb.Close()
+		return nil
+	}
 
 	m.insertChan = make(chan TileFetchResult)
+	m.putChan = make(chan tileInsert)
 	m.requestChan = make(chan TileFetchRequest)
+	m.flushChan = make(chan chan error)
+	m.qc = make(chan bool)
 	go m.Run()
 	return &m
 }
 
-func (m *TileDb) readLayers() {
-	m.layerIds = make(map[string]int)
-	rows, err := m.db.Query("SELECT rowid, layer_name FROM layers")
+func (m *TileDb) readLayers() error {
+	rows, err := m.rdb.Query("SELECT rowid, layer_name FROM layers")
 	if err != nil {
-		log.Fatal("Error fetching layer definitions", err.Error())
+		return err
 	}
+	defer rows.Close()
+	layerIds := make(map[string]int)
 	var s string
 	var i int
 	for rows.Next() {
 		if err := rows.Scan(&i, &s); err != nil {
-			log.Fatal(err)
+			return err
 		}
-		m.layerIds[s] = i
+		layerIds[s] = i
 	}
 	if err := rows.Err(); err != nil {
-		log.Fatal(err)
+		return err
 	}
+	m.mu.Lock()
+	m.layerIds = layerIds
+	m.mu.Unlock()
+	return nil
 }
 
-func (m *TileDb) ensureLayer(layer string) {
-	if _, ok := m.layerIds[layer]; !ok {
-		if _, err := m.db.Exec("INSERT OR IGNORE INTO layers(layer_name) VALUES(?)", layer); err != nil {
-			log.Println(err)
+// layerId returns the rowid of the layer, where "" means 'default'.
+func (m *TileDb) layerId(layer string) (int, bool) {
+	if layer == "" {
+		layer = "default"
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	id, ok := m.layerIds[layer]
+	return id, ok
+}
+
+// ensureLayer returns the rowid of the layer, creating the layer if needed.
+func (m *TileDb) ensureLayer(layer string) (int, error) {
+	return m.ensureLayerOn(m.db, layer)
+}
+
+// ensureLayerOn is ensureLayer within the transaction or db q.
+func (m *TileDb) ensureLayerOn(q execer, layer string) (int, error) {
+	if id, ok := m.layerId(layer); ok {
+		return id, nil
+	}
+	if layer == "" {
+		layer = "default"
+	}
+	if _, err := q.Exec("INSERT OR IGNORE INTO layers(layer_name) VALUES(?)", layer); err != nil {
+		return 0, err
+	}
+	var id int
+	if err := q.QueryRow("SELECT rowid FROM layers WHERE layer_name=?", layer).Scan(&id); err != nil {
+		return 0, err
+	}
+	m.mu.Lock()
+	m.layerIds[layer] = id
+	m.mu.Unlock()
+	return id, nil
+}
+
+// Metadata returns the rows of the MBTiles metadata table.
+func (m *TileDb) Metadata() (map[string]string, error) {
+	rows, err := m.rdb.Query("SELECT name, value FROM metadata")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	md := make(map[string]string)
+	var name, value string
+	for rows.Next() {
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, err
 		}
-		m.readLayers()
+		md[name] = value
+	}
+	return md, rows.Err()
+}
+
+// Layers lists the names of all layers stored in the file.
+func (m *TileDb) Layers() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	names := make([]string, 0, len(m.layerIds))
+	for name := range m.layerIds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DefaultLayer returns the name of the layer served by the MBTiles-compatible
+// 'tiles' view.
+func (m *TileDb) DefaultLayer() (string, error) {
+	var name string
+	err := m.rdb.QueryRow("SELECT layer_name FROM layers WHERE rowid=(SELECT CAST(value AS integer) FROM metadata WHERE name='default_layer_id')").Scan(&name)
+	return name, err
+}
+
+// SetDefaultLayer makes the 'tiles' view serve the layer, which is created
+// if it does not exist yet. The tiles of a file written before multi-layer
+// support are moved into the first layer set.
+func (m *TileDb) SetDefaultLayer(layer string) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	id, err := m.ensureLayerOn(tx, layer)
+	if err == nil {
+		_, err = tx.Exec("REPLACE INTO metadata VALUES('default_layer_id', ?)", id)
+	}
+	if err == nil {
+		// The tiles of a file written before multi-layer support belong
+		// to the layer it is first opened for
+		_, err = tx.Exec(`UPDATE OR IGNORE layered_tiles SET layer_id=?
+			WHERE layer_id=(SELECT rowid FROM layers WHERE layer_name=(SELECT value FROM metadata WHERE name='legacy_layer'))`, id)
+	}
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM metadata WHERE name='legacy_layer'")
 	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// RenameLayer renames the layer from to the name to. The tiles of the layer
+// are kept.
+func (m *TileDb) RenameLayer(from, to string) error {
+	if _, ok := m.layerId(from); !ok {
+		return UnknownLayerError{from}
+	}
+	if _, ok := m.layerId(to); ok {
+		return fmt.Errorf("maptiles: layer %q already exists", to)
+	}
+	if _, err := m.db.Exec("UPDATE layers SET layer_name=? WHERE layer_name=?", to, from); err != nil {
+		return err
+	}
+	return m.readLayers()
+}
+
+// DeleteLayer removes the layer and all of its tiles. The default layer
+// cannot be deleted.
+func (m *TileDb) DeleteLayer(layer string) error {
+	id, ok := m.layerId(layer)
+	if !ok {
+		return UnknownLayerError{layer}
+	}
+	if def, err := m.DefaultLayer(); err != nil {
+		return err
+	} else if def == layer {
+		return fmt.Errorf("maptiles: cannot delete default layer %q", layer)
+	}
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	queries := []string{
+		"DELETE FROM layered_tiles WHERE layer_id=?",
+		"DELETE FROM layers WHERE rowid=?",
+	}
+	for _, query := range queries {
+		if _, err = tx.Exec(query, id); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if _, err = tx.Exec(gcQuery); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	return m.readLayers()
 }
 
 func (m *TileDb) Close() {
 	close(m.insertChan)
 	close(m.requestChan)
-	if m.qc != nil {
-		<-m.qc // block until channel qc is closed (meaning Run() is finished)
+	<-m.qc // block until channel qc is closed (meaning Run() is finished)
+	if err := m.rdb.Close(); err != nil {
+		log.Print(err)
 	}
 	if err := m.db.Close(); err != nil {
 		log.Print(err)
@@ -104,100 +349,279 @@ func (m *TileDb) Close() {
 
 }
 
-func (m TileDb) InsertQueue() chan<- TileFetchResult {
+func (m *TileDb) InsertQueue() chan<- TileFetchResult {
 	return m.insertChan
 }
 
-func (m TileDb) RequestQueue() chan<- TileFetchRequest {
+func (m *TileDb) RequestQueue() chan<- TileFetchRequest {
 	return m.requestChan
 }
 
-// Best executed in a dedicated go routine.
+// Flush returns once the inserts queued so far are committed, reporting
+// the first error of the InsertQueue since the last Flush. Put reports
+// its errors itself.
+func (m *TileDb) Flush() error {
+	done := make(chan error, 1)
+	select {
+	case m.flushChan <- done:
+	case <-m.qc:
+		return fmt.Errorf("maptiles: tile db %s is closed", m.path)
+	}
+	return <-done
+}
+
+// Best executed in a dedicated go routine. Serves each request of the
+// RequestQueue in a goroutine of its own and commits the inserts as
+// batches. Returns once the queues are closed and all queued inserts are
+// written, see Close.
 func (m *TileDb) Run() {
-	m.qc = make(chan bool)
+	var fetches sync.WaitGroup
+	defer close(m.qc)
+	defer fetches.Wait()
+	fetches.Add(1)
+	go func() {
+		defer fetches.Done()
+		// Requests don't wait for the writer
+		for r := range m.requestChan {
+			fetches.Add(1)
+			go func(r TileFetchRequest) {
+				defer fetches.Done()
+				m.fetch(r)
+			}(r)
+		}
+	}()
+	var (
+		werr    error
+		pending []tileInsert
+		timer   *time.Timer
+		timeout <-chan time.Time
+	)
+	commit := func() {
+		if timer != nil {
+			timer.Stop()
+			timer, timeout = nil, nil
+		}
+		if len(pending) == 0 {
+			return
+		}
+		if err := m.writeBatch(pending); err != nil && werr == nil {
+			werr = err
+		}
+		pending = nil
+	}
+	defer commit()
+	// queued commits the pending inserts once the batch is full or, with
+	// a FlushInterval, starts the timer of the batch
+	queued := func() {
+		switch {
+		case len(pending) >= m.opts.BatchSize:
+			commit()
+		case m.opts.FlushInterval <= 0:
+			pending = m.gather(pending)
+			commit()
+		case timer == nil:
+			timer = time.NewTimer(m.opts.FlushInterval)
+			timeout = timer.C
+		}
+	}
 	for {
 		select {
-		case r := <-m.requestChan:
-			m.fetch(r)
-		case i := <-m.insertChan:
-			m.insert(i)
+		case i, ok := <-m.insertChan:
+			if !ok {
+				return
+			}
+			pending = append(pending, tileInsert{TileFetchResult: i})
+			queued()
+		case i := <-m.putChan:
+			pending = append(pending, i)
+			queued()
+		case <-timeout:
+			commit()
+		case done := <-m.flushChan:
+			commit()
+			done <- werr
+			werr = nil
 		}
 	}
-	m.qc <- true
 }
 
-func (m *TileDb) insert(i TileFetchResult) {
-	i.Coord.setTMS(true)
-	x, y, z, l := i.Coord.X, i.Coord.Y, i.Coord.Zoom, i.Coord.Layer
-	if l == "" {
-		l = "default"
+// gather adds the inserts waiting in the queues to the batch.
+func (m *TileDb) gather(batch []tileInsert) []tileInsert {
+	for len(batch) < m.opts.BatchSize {
+		select {
+		case i, ok := <-m.insertChan:
+			if !ok {
+				return batch
+			}
+			batch = append(batch, tileInsert{TileFetchResult: i})
+		case i := <-m.putChan:
+			batch = append(batch, i)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
+// writeBatch inserts the tiles in one transaction. Tiles that fail are
+// logged and skipped. Each Put gets its own result, the returned error is
+// the first one of the InsertQueue.
+func (m *TileDb) writeBatch(batch []tileInsert) error {
+	errs := make([]error, len(batch))
+	txErr := m.writeTx(batch, errs)
+	var first error
+	for k, i := range batch {
+		err := errs[k]
+		if txErr != nil {
+			err = txErr
+		}
+		if i.done != nil {
+			i.done <- err
+		} else if first == nil {
+			first = err
+		}
 	}
-	h := md5.New()
-	_, err := h.Write(i.Blob)
+	return first
+}
+
+// writeTx inserts the batch in a transaction, setting errs of the tiles
+// that fail. It returns the error of the transaction itself.
+func (m *TileDb) writeTx(batch []tileInsert, errs []error) error {
+	tx, err := m.db.Begin()
 	if err != nil {
 		log.Println(err)
-		return
+		return err
+	}
+	w := batchWriter{m: m, tx: tx, now: time.Now().Unix()}
+	if w.blob, err = tx.Prepare("INSERT OR IGNORE INTO tile_blobs(checksum, tile_data) VALUES(?, ?)"); err == nil {
+		w.tile, err = tx.Prepare("REPLACE INTO layered_tiles(layer_id, zoom_level, tile_column, tile_row, checksum, updated_at) VALUES(?, ?, ?, ?, ?, ?)")
 	}
-	s := fmt.Sprintf("%x", h.Sum(nil))
-	row := m.db.QueryRow("SELECT 1 FROM tile_blobs WHERE checksum=?", s)
-	// Sets the synchronous flag to OFF for (much) faster inserts.
-	// See http://www.sqlite.org/pragma.html#pragma_synchronous
-	_, err = m.db.Exec("PRAGMA synchronous=OFF")
 	if err != nil {
-		log.Println("error during pragma", err)
+		log.Println(err)
+		tx.Rollback()
+		return err
 	}
-	var dummy uint64
-	err = row.Scan(&dummy)
-	switch {
-	case err == sql.ErrNoRows:
-		if _, err = m.db.Exec("REPLACE INTO tile_blobs VALUES(?,?)", s, i.Blob); err != nil {
-			log.Println("error during insert", err)
-			return
+	for k, i := range batch {
+		if errs[k] = w.insert(i); errs[k] != nil {
+			log.Println(errs[k])
 		}
-	case err != nil:
-		log.Println("error during test", err)
-		return
-	default:
-		//log.Println("Reusing blob", s)
-	}
-	// m.ensureLayer(l)
-	// layer_id := m.layerIds[l]
-	layer_id := "0"
-	sql := "REPLACE INTO layered_tiles VALUES(?, ?, ?, ?, ?)"
-	if _, err = m.db.Exec(sql, layer_id, z, x, y, s); err != nil {
+	}
+	w.blob.Close()
+	w.tile.Close()
+	if err := tx.Commit(); err != nil {
 		log.Println(err)
+		// Layers created in the transaction are gone as well
+		m.readLayers()
+		return err
+	}
+	return nil
+}
+
+// tileInsert is a queued insert. Inserts of Put and PutStamped wait for
+// their own result on done, those of the InsertQueue have none.
+type tileInsert struct {
+	TileFetchResult
+	stamp time.Time  // the zero time means the time of the commit
+	done  chan error // buffered
+}
+
+// batchWriter holds the prepared statements of a transaction.
+type batchWriter struct {
+	m    *TileDb
+	tx   *sql.Tx
+	blob *sql.Stmt
+	tile *sql.Stmt
+	now  int64 // timestamp of the tiles without one of their own
+}
+
+func (w batchWriter) insert(i tileInsert) error {
+	i.Coord.setTMS(true)
+	x, y, z, l := i.Coord.X, i.Coord.Y, i.Coord.Zoom, i.Coord.Layer
+	s := fmt.Sprintf("%x", md5.Sum(i.Blob))
+	if _, err := w.blob.Exec(s, i.Blob); err != nil {
+		return err
 	}
-	_, err = m.db.Exec("PRAGMA synchronous=NORMAL")
+	layer_id, err := w.m.ensureLayerOn(w.tx, l)
 	if err != nil {
-		log.Println("error during pragma", err)
+		return err
+	}
+	stamp := w.now
+	if !i.stamp.IsZero() {
+		stamp = i.stamp.Unix()
+	}
+	_, err = w.tile.Exec(layer_id, z, x, y, s, stamp)
+	return err
+}
+
+// FetchTile looks up the tile c, returning a nil blob and no error if it is
+// not stored. Inserts that are still queued are not seen, see Flush. The
+// query is aborted when ctx is cancelled.
+func (m *TileDb) FetchTile(ctx context.Context, c TileCoord) ([]byte, error) {
+	ch := make(chan TileFetchResult, 1)
+	m.fetch(TileFetchRequest{c, ch, ctx})
+	select {
+	case result := <-ch:
+		return result.Blob, result.Err
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
 }
 
 func (m *TileDb) fetch(r TileFetchRequest) {
-	r.Coord.setTMS(true)
-	zoom, x, y := r.Coord.Zoom, r.Coord.X, r.Coord.Y
-	result := TileFetchResult{r.Coord, nil}
+	ctx := r.Context()
+	if ctx.Err() != nil {
+		// Requester is gone, don't bother the db
+		return
+	}
+	result := TileFetchResult{r.Coord, nil, nil}
+	result.Coord.setTMS(true)
+	result.Blob, _, result.Err = m.lookup(ctx, r.Coord)
+	r.reply(result)
+}
+
+// GetStamped is Get that also returns when the tile was stored, the zero
+// time for tiles of files written before timestamps were recorded.
+func (m *TileDb) GetStamped(ctx context.Context, c TileCoord) ([]byte, time.Time, error) {
+	blob, stamp, err := m.lookup(ctx, c)
+	if err == nil && blob == nil {
+		err = ErrTileNotFound
+	}
+	return blob, stamp, err
+}
+
+// lookup returns the tile c and its timestamp, a nil blob and no error if
+// it is not stored.
+func (m *TileDb) lookup(ctx context.Context, c TileCoord) ([]byte, time.Time, error) {
+	c.setTMS(true)
+	layer_id, ok := m.layerId(c.Layer)
+	if !ok {
+		// Nothing was ever stored for this layer
+		return nil, time.Time{}, nil
+	}
 	queryString := `
-		SELECT tile_data
-		FROM tile_blobs
-		WHERE checksum=(
-			SELECT checksum
-			FROM layered_tiles
-			WHERE zoom_level=?
-				AND tile_column=?
-				AND tile_row=?
-				AND layer_id='0'
-		)`
+		SELECT tile_data, updated_at
+		FROM layered_tiles JOIN tile_blobs USING (checksum)
+		WHERE zoom_level=?
+			AND tile_column=?
+			AND tile_row=?
+			AND layer_id=?`
 	var blob []byte
-	row := m.db.QueryRow(queryString, zoom, x, y)
-	err := row.Scan(&blob)
+	var updated sql.NullInt64
+	row := m.rdb.QueryRowContext(ctx, queryString, c.Zoom, c.X, c.Y, layer_id)
+	err := row.Scan(&blob, &updated)
 	switch {
 	case err == sql.ErrNoRows:
-		result.Blob = nil
+		return nil, time.Time{}, nil
 	case err != nil:
-		log.Println(err)
-	default:
-		result.Blob = blob
+		if ctx.Err() == nil {
+			// Not just a client that went away
+			log.Println(err)
+		}
+		return nil, time.Time{}, err
+	}
+	var stamp time.Time
+	if updated.Valid {
+		stamp = time.Unix(updated.Int64, 0)
 	}
-	r.OutChan <- result
+	return blob, stamp, nil
 }
@@ -0,0 +1,311 @@
+package maptiles
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func tempTileDb(t *testing.T) (*TileDb, func()) {
+	dir, err := ioutil.TempDir("", "tiledb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewTileDb(filepath.Join(dir, "test.mbtiles"))
+	if m == nil {
+		os.RemoveAll(dir)
+		t.Fatal("NewTileDb failed")
+	}
+	return m, func() {
+		m.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func fetchBlob(m *TileDb, tc TileCoord) []byte {
+	blob, _ := m.FetchTile(context.Background(), tc)
+	return blob
+}
+
+// TestTileDbLayers test tiles are stored and fetched per layer.
+func TestTileDbLayers(t *testing.T) {
+	m, cleanup := tempTileDb(t)
+	defer cleanup()
+
+	street := TileCoord{X: 1, Y: 2, Zoom: 3, Layer: "street"}
+	admin := street
+	admin.Layer = "admin"
+	m.InsertQueue() <- TileFetchResult{street, []byte("street"), nil}
+	m.InsertQueue() <- TileFetchResult{admin, []byte("admin"), nil}
+	if err := m.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := string(fetchBlob(m, street)); got != "street" {
+		t.Errorf("street: got %q; want %q", got, "street")
+	}
+	if got := string(fetchBlob(m, admin)); got != "admin" {
+		t.Errorf("admin: got %q; want %q", got, "admin")
+	}
+	if got := fetchBlob(m, TileCoord{X: 1, Y: 2, Zoom: 3}); got != nil {
+		t.Errorf("default: got %q; want nil", got)
+	}
+
+	// The MBTiles view serves the chosen default layer only
+	if err := m.SetDefaultLayer("admin"); err != nil {
+		t.Fatal(err)
+	}
+	var blob []byte
+	if err := m.db.QueryRow("SELECT tile_data FROM tiles").Scan(&blob); err != nil {
+		t.Fatal(err)
+	}
+	if string(blob) != "admin" {
+		t.Errorf("tiles view: got %q; want %q", blob, "admin")
+	}
+
+	if err := m.RenameLayer("street", "streets"); err != nil {
+		t.Fatal(err)
+	}
+	street.Layer = "streets"
+	if got := string(fetchBlob(m, street)); got != "street" {
+		t.Errorf("renamed: got %q; want %q", got, "street")
+	}
+	if err := m.DeleteLayer("admin"); err == nil {
+		t.Error("DeleteLayer: deleted the default layer")
+	}
+	if err := m.DeleteLayer("streets"); err != nil {
+		t.Fatal(err)
+	}
+	if got := fetchBlob(m, street); got != nil {
+		t.Errorf("deleted: got %q; want nil", got)
+	}
+	want := []string{"admin", "default"}
+	if got := m.Layers(); len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("Layers: got %v; want %v", got, want)
+	}
+}
+
+// TestTileDbLegacy test tiles of files written before multi-layer support
+// belong to the layer the file is opened for.
+func TestTileDbLegacy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tiledb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "osm_png.mbtiles")
+	db, err := sql.Open("sqlite3", fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, query := range []string{
+		"CREATE TABLE layers(layer_name text PRIMARY KEY NOT NULL)",
+		"CREATE TABLE metadata (name text PRIMARY KEY NOT NULL, value text NOT NULL)",
+		"CREATE TABLE layered_tiles (layer_id integer, zoom_level integer, tile_column integer, tile_row integer, checksum text, PRIMARY KEY (layer_id, zoom_level, tile_column, tile_row) FOREIGN KEY(checksum) REFERENCES tile_blobs(checksum))",
+		"CREATE TABLE tile_blobs (checksum text, tile_data blob)",
+		"INSERT INTO layers(layer_name) VALUES('default')",
+		"INSERT INTO tile_blobs VALUES('x', 'legacy')",
+		"INSERT INTO layered_tiles VALUES(0, 3, 1, 2, 'x')",
+	} {
+		if _, err := db.Exec(query); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	m := NewTileDb(fn)
+	if m == nil {
+		t.Fatal("NewTileDb failed")
+	}
+	defer m.Close()
+	if err := m.SetDefaultLayer("osm"); err != nil {
+		t.Fatal(err)
+	}
+	c := TileCoord{X: 1, Y: 2, Zoom: 3, Layer: "osm", Tms: true}
+	if got := string(fetchBlob(m, c)); got != "legacy" {
+		t.Errorf("legacy tile: got %q; want %q", got, "legacy")
+	}
+	var n int
+	if err := m.rdb.QueryRow("SELECT count(*) FROM tiles").Scan(&n); err != nil || n != 1 {
+		t.Errorf("tiles view: got %d tiles, %v; want 1", n, err)
+	}
+
+	// Only the first layer set takes the tiles
+	if err := m.SetDefaultLayer("sat"); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(fetchBlob(m, c)); got != "legacy" {
+		t.Errorf("legacy tile after second SetDefaultLayer: got %q; want %q", got, "legacy")
+	}
+}
+
+// TestTileDbMetadata test typed metadata survives reopening the file.
+func TestTileDbMetadata(t *testing.T) {
+	m, cleanup := tempTileDb(t)
+	defer cleanup()
+
+	md := &MBTilesMetadata{
+		Name:         "streets",
+		Format:       "pbf",
+		Bounds:       [4]float64{5.8, 47.2, 15.1, 55.1},
+		MinZoom:      2,
+		MaxZoom:      14,
+		Attribution:  "(c) OpenStreetMap contributors",
+		VectorLayers: []byte(`[{"id":"roads","fields":{}}]`),
+	}
+	if err := m.WriteMetadata(md); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.WriteMetadata(&MBTilesMetadata{Description: "roads only"}); err != nil {
+		t.Fatal(err)
+	}
+	reopened := NewTileDb(m.path)
+	if reopened == nil {
+		t.Fatal("NewTileDb failed")
+	}
+	defer reopened.Close()
+	got, err := reopened.ReadMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != md.Name || got.Format != "pbf" || got.Bounds != md.Bounds || got.MinZoom != 2 || got.MaxZoom != 14 ||
+		got.Attribution != md.Attribution || got.Description != "roads only" || string(got.VectorLayers) != string(md.VectorLayers) {
+		t.Errorf("ReadMetadata: got %+v", got)
+	}
+}
+
+// TestTileDbConcurrency test fetches run in parallel with the writer.
+func TestTileDbConcurrency(t *testing.T) {
+	m, cleanup := tempTileDb(t)
+	defer cleanup()
+
+	var mode string
+	if err := m.rdb.QueryRow("PRAGMA journal_mode").Scan(&mode); err != nil || mode != "wal" {
+		t.Errorf("journal_mode: got %q, %v; want %q", mode, err, "wal")
+	}
+	done := make(chan bool)
+	go func() {
+		for x := uint64(0); x < 64; x++ {
+			m.InsertQueue() <- TileFetchResult{TileCoord{X: x, Zoom: 6}, []byte{byte(x)}, nil}
+		}
+		close(done)
+	}()
+	ctx := context.Background()
+	for x := uint64(0); x < 64; x++ {
+		if _, err := m.FetchTile(ctx, TileCoord{X: x, Zoom: 6}); err != nil {
+			t.Error(err)
+		}
+	}
+	<-done
+	if err := m.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for x := uint64(0); x < 64; x++ {
+		if blob := fetchBlob(m, TileCoord{X: x, Zoom: 6}); len(blob) != 1 || blob[0] != byte(x) {
+			t.Fatalf("tile %d: got %v", x, blob)
+		}
+	}
+}
+
+// TestTileDbBatching test queued inserts are committed after the flush
+// interval and on Close, and Put waits for its own batch.
+func TestTileDbBatching(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tiledb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "batch.mbtiles")
+	m := NewTileDbWithOptions(fn, TileDbOptions{BatchSize: 1000, FlushInterval: 20 * time.Millisecond})
+	if m == nil {
+		t.Fatal("NewTileDbWithOptions failed")
+	}
+	first := TileCoord{X: 1, Zoom: 1}
+	m.InsertQueue() <- TileFetchResult{first, []byte("first"), nil}
+	deadline := time.Now().Add(5 * time.Second)
+	for fetchBlob(m, first) == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("insert not committed after the flush interval")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	m.Close()
+
+	m = NewTileDbWithOptions(fn, TileDbOptions{BatchSize: 1000, FlushInterval: time.Hour})
+	if m == nil {
+		t.Fatal("NewTileDbWithOptions failed")
+	}
+	second := TileCoord{X: 0, Zoom: 1}
+	m.InsertQueue() <- TileFetchResult{second, []byte("second"), nil}
+	m.Close()
+	m = NewTileDb(fn)
+	if m == nil {
+		t.Fatal("NewTileDb failed")
+	}
+	defer m.Close()
+	if blob := fetchBlob(m, second); string(blob) != "second" {
+		t.Errorf("insert lost on Close: got %q", blob)
+	}
+
+	// Put waits for its batch instead of flushing the queue
+	batched := NewTileDbWithOptions(filepath.Join(dir, "put.mbtiles"), TileDbOptions{BatchSize: 2, FlushInterval: time.Hour})
+	if batched == nil {
+		t.Fatal("NewTileDbWithOptions failed")
+	}
+	defer batched.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := batched.Put(ctx, first, []byte("first")); err != context.DeadlineExceeded {
+		t.Errorf("Put of a batch not yet full: got %v; want %v", err, context.DeadlineExceeded)
+	}
+	if err := batched.Put(context.Background(), second, []byte("second")); err != nil {
+		t.Errorf("Put: %v", err)
+	}
+	for _, c := range []TileCoord{first, second} {
+		if blob := fetchBlob(batched, c); blob == nil {
+			t.Errorf("Put: tile %v of the full batch not committed", c)
+		}
+	}
+}
+
+// BenchmarkTileDbInsert measures seeding throughput, reported as tiles/s,
+// with a transaction per tile and with the batches of NewTileDb.
+func BenchmarkTileDbInsert(b *testing.B) {
+	b.Run("unbatched", func(b *testing.B) {
+		benchmarkTileDbInsert(b, TileDbOptions{BatchSize: 1, FlushInterval: 0})
+	})
+	b.Run("batched", func(b *testing.B) {
+		benchmarkTileDbInsert(b, DefaultTileDbOptions)
+	})
+}
+
+func benchmarkTileDbInsert(b *testing.B, opts TileDbOptions) {
+	dir, err := ioutil.TempDir("", "tiledb")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	m := NewTileDbWithOptions(filepath.Join(dir, "bench.mbtiles"), opts)
+	if m == nil {
+		b.Fatal("NewTileDbWithOptions failed")
+	}
+	defer m.Close()
+
+	blob := make([]byte, 4096)
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		// distinct tiles with distinct blobs, as when seeding
+		blob[0], blob[1], blob[2] = byte(i), byte(i>>8), byte(i>>16)
+		c := TileCoord{X: uint64(i) % (1 << 12), Y: uint64(i) / (1 << 12), Zoom: 12}
+		m.InsertQueue() <- TileFetchResult{c, append([]byte(nil), blob...), nil}
+	}
+	if err := m.Flush(); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "tiles/s")
+}
@@ -0,0 +1,134 @@
+package maptiles
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps the most recently used tiles in memory, up to
+// MaxBytes of tile data.
+type MemoryStore struct {
+	MaxBytes int64
+
+	mu    sync.Mutex
+	ll    *list.List // front is most recently used
+	items map[string]*list.Element
+	bytes int64
+}
+
+type memEntry struct {
+	key   string
+	c     TileCoord // XYZ
+	blob  []byte
+	stamp time.Time
+}
+
+func NewMemoryStore(maxBytes int64) *MemoryStore {
+	return &MemoryStore{
+		MaxBytes: maxBytes,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+func (s *MemoryStore) Get(ctx context.Context, c TileCoord) ([]byte, error) {
+	blob, _, err := s.GetStamped(ctx, c)
+	return blob, err
+}
+
+// GetStamped returns the time of the Put or the stamp of PutStamped as
+// timestamp.
+func (s *MemoryStore) GetStamped(ctx context.Context, c TileCoord) ([]byte, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.items[storeKey(c)]
+	if !ok {
+		return nil, time.Time{}, ErrTileNotFound
+	}
+	s.ll.MoveToFront(e)
+	entry := e.Value.(*memEntry)
+	return entry.blob, entry.stamp, nil
+}
+
+// Put stores the tile, evicting the least recently used tiles as needed.
+// Tiles larger than MaxBytes are not stored.
+func (s *MemoryStore) Put(ctx context.Context, c TileCoord, blob []byte) error {
+	return s.PutStamped(ctx, c, blob, time.Time{})
+}
+
+// PutStamped is Put with the timestamp of the tile, the zero time means
+// now.
+func (s *MemoryStore) PutStamped(ctx context.Context, c TileCoord, blob []byte, stamp time.Time) error {
+	if stamp.IsZero() {
+		stamp = time.Now()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := storeKey(c)
+	if e, ok := s.items[key]; ok {
+		s.remove(e)
+	}
+	if int64(len(blob)) > s.MaxBytes {
+		return nil
+	}
+	c.setTMS(false)
+	s.items[key] = s.ll.PushFront(&memEntry{key, c, blob, stamp})
+	s.bytes += int64(len(blob))
+	for s.bytes > s.MaxBytes {
+		s.remove(s.ll.Back())
+	}
+	return nil
+}
+
+func (s *MemoryStore) Delete(ctx context.Context, c TileCoord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.items[storeKey(c)]; ok {
+		s.remove(e)
+	}
+	return nil
+}
+
+func (s *MemoryStore) Has(ctx context.Context, c TileCoord) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.items[storeKey(c)]
+	return ok, nil
+}
+
+// PurgeRanges removes the tiles of the layer in the ranges.
+func (s *MemoryStore) PurgeRanges(ctx context.Context, layer string, ranges []TileRange) (int64, error) {
+	zooms := rangesByZoom(ranges)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int64
+	for _, e := range s.items {
+		entry := e.Value.(*memEntry)
+		if entry.c.Layer != layer {
+			continue
+		}
+		for _, r := range zooms[entry.c.Zoom] {
+			if r.contains(entry.c) {
+				s.remove(e)
+				n++
+				break
+			}
+		}
+	}
+	return n, nil
+}
+
+// Len returns the number of tiles and their total size.
+func (s *MemoryStore) Len() (tiles int, bytes int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ll.Len(), s.bytes
+}
+
+func (s *MemoryStore) remove(e *list.Element) {
+	entry := s.ll.Remove(e).(*memEntry)
+	delete(s.items, entry.key)
+	s.bytes -= int64(len(entry.blob))
+}
@@ -0,0 +1,148 @@
+package maptiles
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// Typed MBTiles 1.3 metadata, see
+// https://github.com/mapbox/mbtiles-spec/blob/master/1.3/spec.md
+// Empty fields are not written by WriteMetadata.
+type MBTilesMetadata struct {
+	Name         string
+	Format       string     // pbf, jpg, png or webp
+	Bounds       [4]float64 // west, south, east, north in degrees, all zero means unset
+	Center       [3]float64 // longitude, latitude, zoom, all zero means unset
+	MinZoom      uint64
+	MaxZoom      uint64 // 0 means unset, MinZoom is only written along with it
+	Attribution  string
+	Description  string
+	Type         string          // overlay or baselayer
+	Version      string          // of the tileset
+	VectorLayers json.RawMessage // vector_layers of the json row, required for pbf
+}
+
+// ReadMetadata parses the metadata table. Rows that are missing or can't
+// be parsed leave their field empty.
+func (m *TileDb) ReadMetadata() (*MBTilesMetadata, error) {
+	rows, err := m.Metadata()
+	if err != nil {
+		return nil, err
+	}
+	md := &MBTilesMetadata{
+		Name:        rows["name"],
+		Format:      rows["format"],
+		Attribution: rows["attribution"],
+		Description: rows["description"],
+		Type:        rows["type"],
+		Version:     rows["version"],
+	}
+	if v := parseFloats(rows["bounds"]); len(v) == 4 {
+		copy(md.Bounds[:], v)
+	}
+	if v := parseFloats(rows["center"]); len(v) == 3 {
+		copy(md.Center[:], v)
+	}
+	md.MinZoom, _ = strconv.ParseUint(rows["minzoom"], 10, 64)
+	md.MaxZoom, _ = strconv.ParseUint(rows["maxzoom"], 10, 64)
+	if v := rows["json"]; v != "" {
+		var doc struct {
+			VectorLayers json.RawMessage `json:"vector_layers"`
+		}
+		if err := json.Unmarshal([]byte(v), &doc); err == nil {
+			md.VectorLayers = doc.VectorLayers
+		}
+	}
+	return md, nil
+}
+
+// WriteMetadata stores the non-empty fields of md, keeping the other rows.
+// VectorLayers replaces the vector_layers key of the json row only.
+func (m *TileDb) WriteMetadata(md *MBTilesMetadata) error {
+	rows := map[string]string{
+		"name":        md.Name,
+		"format":      md.Format,
+		"attribution": md.Attribution,
+		"description": md.Description,
+		"type":        md.Type,
+		"version":     md.Version,
+	}
+	if md.Bounds != [4]float64{} {
+		rows["bounds"] = formatFloats(md.Bounds[:])
+	}
+	if md.Center != [3]float64{} {
+		rows["center"] = formatFloats(md.Center[:])
+	}
+	if md.MaxZoom != 0 {
+		rows["minzoom"] = strconv.FormatUint(md.MinZoom, 10)
+		rows["maxzoom"] = strconv.FormatUint(md.MaxZoom, 10)
+	}
+	if md.VectorLayers != nil {
+		doc := make(map[string]json.RawMessage)
+		var old string
+		if err := m.rdb.QueryRow("SELECT value FROM metadata WHERE name='json'").Scan(&old); err == nil {
+			// A broken document is replaced
+			json.Unmarshal([]byte(old), &doc)
+		}
+		doc["vector_layers"] = md.VectorLayers
+		b, err := json.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		rows["json"] = string(b)
+	}
+
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	for name, value := range rows {
+		if value == "" {
+			continue
+		}
+		if _, err := tx.Exec("REPLACE INTO metadata VALUES(?, ?)", name, value); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// SetMetadata writes a single metadata row.
+func (m *TileDb) SetMetadata(name, value string) error {
+	_, err := m.db.Exec("REPLACE INTO metadata VALUES(?, ?)", name, value)
+	return err
+}
+
+// initMetadata writes the rows that are not set yet.
+func (m *TileDb) initMetadata(rows map[string]string) error {
+	for name, value := range rows {
+		if _, err := m.db.Exec("INSERT OR IGNORE INTO metadata VALUES(?, ?)", name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mbtilesFormat maps a tile format as used in TileCoord to the format
+// metadata value.
+func mbtilesFormat(format string) string {
+	switch {
+	case strings.HasSuffix(format, "pbf"):
+		return "pbf"
+	case strings.HasPrefix(format, "jp"):
+		return "jpg"
+	case strings.HasPrefix(format, "webp"):
+		return "webp"
+	}
+	return "png"
+}
+
+func formatFloats(fs []float64) string {
+	s := make([]string, len(fs))
+	for i, f := range fs {
+		s[i] = strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return strings.Join(s, ",")
+}
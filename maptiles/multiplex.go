@@ -1,43 +1,228 @@
 package maptiles
 
-import "log"
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
 
+// UnknownLayerError is returned when a request names a layer that has no
+// registered source in a LayerMultiplex.
+type UnknownLayerError struct {
+	Layer string
+}
+
+func (e UnknownLayerError) Error() string {
+	return fmt.Sprintf("maptiles: unknown layer %q", e.Layer)
+}
+
+// layerSource is a source registered under one or more layer names.
+type layerSource struct {
+	c     chan<- TileFetchRequest
+	owned bool // channel was created by the multiplex and is closed on removal
+	auto  bool // added by AddTileRendererIfAbsent, not listed by Layers
+	names int  // layer names referring to the source, guarded by the multiplex
+	// SubmitRequests sending on c, which must not be closed before they
+	// are done
+	senders sync.WaitGroup
+	removed chan struct{} // closed when the last layer name is gone
+}
+
+func newLayerSource(c chan<- TileFetchRequest, owned bool) *layerSource {
+	return &layerSource{c: c, owned: owned, removed: make(chan struct{})}
+}
+
+// Routes tile requests to a source per layer name, see TileCoord.Layer.
+// Sources can be added, replaced and removed while requests are served.
 type LayerMultiplex struct {
-	layerChans map[string]chan<- TileFetchRequest
+	mu     sync.RWMutex
+	layers map[string]*layerSource
+	infos  map[string]LayerInfo
 }
 
 func NewLayerMultiplex() *LayerMultiplex {
 	l := LayerMultiplex{}
-	l.layerChans = make(map[string]chan<- TileFetchRequest)
+	l.layers = make(map[string]*layerSource)
+	l.infos = make(map[string]LayerInfo)
 	return &l
 }
 
 func DefaultRenderMultiplex(defaultStylesheet string) *LayerMultiplex {
 	l := NewLayerMultiplex()
-	c := NewTileRendererChan(defaultStylesheet)
-	l.layerChans[""] = c
-	l.layerChans["default"] = c
+	s := newLayerSource(NewTileRendererChan(defaultStylesheet), true)
+	s.names = 2
+	l.layers[""] = s
+	l.layers["default"] = s
 	return l
 }
 
-func (l *LayerMultiplex) AddRenderer(name string, url string) {
-	name = "default"
-	l.layerChans[name] = NewTileRendererChan(url)
+// AddRenderer registers a new TileRenderer for the layer name, replacing
+// any source previously registered under that name. The url must be a
+// valid URLTemplate.
+func (l *LayerMultiplex) AddRenderer(name string, url string) error {
+	if _, err := ParseURLTemplate(url); err != nil {
+		return err
+	}
+	l.set(name, newLayerSource(NewTileRendererChan(url), true))
+	return nil
+}
+
+// AddTileRenderer registers r for the layer name, replacing any source
+// previously registered under that name. The multiplex takes ownership of
+// r, see NewRendererChan.
+func (l *LayerMultiplex) AddTileRenderer(name string, r Renderer) {
+	l.set(name, newLayerSource(NewRendererChan(r), true))
 }
 
+// AddTileRendererIfAbsent registers the renderer returned by newRenderer
+// for the layer name unless a source is registered for it already. It
+// reports whether the renderer was added; newRenderer is only called then.
+// Such layers exist for any name a client asks for and are left out of
+// Layers unless they have a LayerInfo.
+func (l *LayerMultiplex) AddTileRendererIfAbsent(name string, newRenderer func() Renderer) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.layers[name]; ok {
+		return false
+	}
+	s := newLayerSource(NewRendererChan(newRenderer()), true)
+	s.names = 1
+	s.auto = true
+	l.layers[name] = s
+	return true
+}
+
+// AddSource registers fetchChan for the layer name, replacing any source
+// previously registered under that name. The multiplex never closes
+// fetchChan, that is left to the caller.
 func (l *LayerMultiplex) AddSource(name string, fetchChan chan<- TileFetchRequest) {
-	name = "default"
-	l.layerChans[name] = fetchChan
+	l.set(name, newLayerSource(fetchChan, false))
 }
 
-func (l LayerMultiplex) SubmitRequest(r TileFetchRequest) bool {
-	// name = r.Coord.Layer
-	name := "default"
-	c, ok := l.layerChans[name]
+// RemoveSource unregisters the source and the LayerInfo of the layer
+// name. It reports whether a source was registered.
+func (l *LayerMultiplex) RemoveSource(name string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s, ok := l.layers[name]
 	if ok {
-		c <- r
-	} else {
-		log.Println("No such layer", r.Coord.Layer)
+		delete(l.layers, name)
+		l.release(s)
+	}
+	delete(l.infos, name)
+	return ok
+}
+
+// SetLayerInfo describes the layer name. The description is kept when the
+// source of the layer is replaced.
+func (l *LayerMultiplex) SetLayerInfo(name string, info LayerInfo) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.infos[name] = info
+}
+
+// LayerInfo returns the description set with SetLayerInfo.
+func (l *LayerMultiplex) LayerInfo(name string) (LayerInfo, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	info, ok := l.infos[name]
+	return info, ok
+}
+
+// Layers lists the names of all layers with a registered source, but not
+// those added by AddTileRendererIfAbsent without a LayerInfo.
+func (l *LayerMultiplex) Layers() []string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	names := make([]string, 0, len(l.layers))
+	for name, s := range l.layers {
+		if _, ok := l.infos[name]; s.auto && !ok {
+			continue
+		}
+		names = append(names, name)
 	}
+	sort.Strings(names)
+	return names
+}
+
+// HasLayer reports whether a source is registered for the layer name.
+func (l *LayerMultiplex) HasLayer(name string) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	_, ok := l.layers[name]
 	return ok
 }
+
+// SubmitRequest hands r to the source of r.Coord.Layer. If no such source
+// is registered, an UnknownLayerError is returned and nothing is sent on
+// r.OutChan, also if the source is removed before it accepts r. If r is
+// cancelled before the source accepts it, the context error is returned.
+func (l *LayerMultiplex) SubmitRequest(r TileFetchRequest) error {
+	l.mu.RLock()
+	s, ok := l.layers[r.Coord.Layer]
+	if ok {
+		// Keeps the channel open while sending without holding the lock,
+		// see release
+		s.senders.Add(1)
+	}
+	l.mu.RUnlock()
+	if !ok {
+		return UnknownLayerError{r.Coord.Layer}
+	}
+	defer s.senders.Done()
+	select {
+	case s.c <- r:
+		return nil
+	case <-s.removed:
+		return UnknownLayerError{r.Coord.Layer}
+	case <-r.Context().Done():
+		return r.Context().Err()
+	}
+}
+
+// FetchTile submits a request for c and waits for its result or for ctx to
+// be cancelled. The returned error is result.Err unless the request could
+// not be completed at all.
+func (l *LayerMultiplex) FetchTile(ctx context.Context, c TileCoord) (TileFetchResult, error) {
+	ch := make(chan TileFetchResult, 1)
+	if err := l.SubmitRequest(TileFetchRequest{c, ch, ctx}); err != nil {
+		return TileFetchResult{c, nil, err}, err
+	}
+	select {
+	case result := <-ch:
+		if result.Blob == nil && result.Err == nil {
+			result.Err = ErrTileNotFound
+		}
+		return result, result.Err
+	case <-ctx.Done():
+		return TileFetchResult{c, nil, ctx.Err()}, ctx.Err()
+	}
+}
+
+func (l *LayerMultiplex) set(name string, s *layerSource) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	old, ok := l.layers[name]
+	s.names++
+	l.layers[name] = s
+	if ok {
+		l.release(old)
+	}
+}
+
+// release drops a layer name of s. Once no name refers to s, pending
+// SubmitRequests give up and the channel is closed after they are done if
+// the multiplex owns it. Must be called with l.mu held.
+func (l *LayerMultiplex) release(s *layerSource) {
+	if s.names--; s.names > 0 {
+		return
+	}
+	close(s.removed)
+	if s.owned {
+		go func() {
+			s.senders.Wait()
+			close(s.c)
+		}()
+	}
+}
@@ -0,0 +1,99 @@
+package maptiles
+
+import (
+	"testing"
+	"time"
+)
+
+// TestMultiplexRouting test requests are routed on TileCoord.Layer.
+func TestMultiplexRouting(t *testing.T) {
+	lmp := NewLayerMultiplex()
+	street := make(chan TileFetchRequest, 1)
+	satellite := make(chan TileFetchRequest, 1)
+	lmp.AddSource("street", street)
+	lmp.AddSource("satellite", satellite)
+
+	tc := TileCoord{Layer: "satellite"}
+	if err := lmp.SubmitRequest(TileFetchRequest{Coord: tc}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case r := <-satellite:
+		if r.Coord.Layer != "satellite" {
+			t.Errorf("Layer: got %q; want %q", r.Coord.Layer, "satellite")
+		}
+	case <-street:
+		t.Error("request for satellite routed to street")
+	}
+
+	// Replace and remove at runtime
+	replaced := make(chan TileFetchRequest, 1)
+	lmp.AddSource("street", replaced)
+	tc.Layer = "street"
+	if err := lmp.SubmitRequest(TileFetchRequest{Coord: tc}); err != nil {
+		t.Fatal(err)
+	}
+	if len(replaced) != 1 || len(street) != 0 {
+		t.Errorf("replaced source: got %d requests; want 1", len(replaced))
+	}
+	if !lmp.RemoveSource("street") {
+		t.Error("RemoveSource: got false; want true")
+	}
+	err := lmp.SubmitRequest(TileFetchRequest{Coord: tc})
+	if _, ok := err.(UnknownLayerError); !ok {
+		t.Errorf("SubmitRequest: got %v; want UnknownLayerError", err)
+	}
+}
+
+// TestMultiplexLayers test layers added on demand are not listed.
+func TestMultiplexLayers(t *testing.T) {
+	lmp := NewLayerMultiplex()
+	lmp.AddSource("street", make(chan TileFetchRequest))
+	for _, name := range []string{"junk", "satellite"} {
+		lmp.AddTileRendererIfAbsent(name, func() Renderer { return NewTileRenderer("") })
+	}
+	if got := lmp.Layers(); len(got) != 1 || got[0] != "street" {
+		t.Errorf("Layers: got %v; want [street]", got)
+	}
+	if !lmp.HasLayer("junk") {
+		t.Error("HasLayer(junk): got false; want true")
+	}
+	lmp.SetLayerInfo("satellite", LayerInfo{Attribution: "(c) satellite"})
+	if got := lmp.Layers(); len(got) != 2 || got[0] != "satellite" || got[1] != "street" {
+		t.Errorf("Layers: got %v; want [satellite street]", got)
+	}
+	lmp.RemoveSource("junk")
+	lmp.RemoveSource("satellite")
+	lmp.RemoveSource("street")
+}
+
+// TestMultiplexBlockedSource test that a source not accepting requests
+// blocks neither other layers nor changes to the multiplex.
+func TestMultiplexBlockedSource(t *testing.T) {
+	lmp := NewLayerMultiplex()
+	lmp.AddSource("stuck", make(chan TileFetchRequest))
+	errc := make(chan error)
+	go func() {
+		errc <- lmp.SubmitRequest(TileFetchRequest{Coord: TileCoord{Layer: "stuck"}})
+	}()
+
+	done := make(chan bool)
+	go func() {
+		lmp.SetLayerInfo("stuck", LayerInfo{Name: "Stuck"})
+		other := make(chan TileFetchRequest, 1)
+		lmp.AddSource("other", other)
+		if err := lmp.SubmitRequest(TileFetchRequest{Coord: TileCoord{Layer: "other"}}); err != nil {
+			t.Error(err)
+		}
+		lmp.RemoveSource("stuck")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("multiplex blocked by a source not accepting requests")
+	}
+	if _, ok := (<-errc).(UnknownLayerError); !ok {
+		t.Error("SubmitRequest to removed source: got no UnknownLayerError")
+	}
+}
@@ -0,0 +1,68 @@
+package maptiles
+
+import (
+	"strconv"
+	"time"
+)
+
+// CachePolicy tells how long the stored tiles of a layer are served
+// before they are fetched again and how long clients may cache them. The
+// zero CachePolicy serves stored tiles forever without Cache-Control.
+type CachePolicy struct {
+	// Tiles younger than MaxAge are served as stored, 0 means forever.
+	MaxAge time.Duration
+	// Tiles older than MaxAge but younger than StaleAge are served as
+	// stored while they are fetched again in the background. Older tiles
+	// are fetched before they are served, unless the fetch fails.
+	StaleAge time.Duration
+	// Sent as Cache-Control header with the tiles, e.g. "public,
+	// max-age=86400". "" means "max-age=" MaxAge if that is set.
+	CacheControl string
+}
+
+// Freshness of a stored tile.
+const (
+	tileFresh = iota
+	tileStale
+	tileExpired
+)
+
+// freshness classifies a tile stored at stamp. Tiles of an unknown age,
+// i.e. with a zero stamp, are fresh, see StampedStore.
+func (p CachePolicy) freshness(stamp time.Time, now time.Time) int {
+	if p.MaxAge <= 0 || stamp.IsZero() {
+		return tileFresh
+	}
+	age := now.Sub(stamp)
+	switch {
+	case age < p.MaxAge:
+		return tileFresh
+	case age < p.StaleAge:
+		return tileStale
+	}
+	return tileExpired
+}
+
+// cacheControl returns the Cache-Control header of the tiles, "" for none.
+func (p CachePolicy) cacheControl() string {
+	if p.CacheControl == "" && p.MaxAge > 0 {
+		return "max-age=" + strconv.FormatInt(int64(p.MaxAge/time.Second), 10)
+	}
+	return p.CacheControl
+}
+
+// SetCachePolicy sets how long the stored tiles of the layer are served,
+// see CachePolicy. Only stores that are a StampedStore, like DbStore,
+// know the age of their tiles.
+func (t *TileServer) SetCachePolicy(layer string, p CachePolicy) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.policies[layer] = p
+}
+
+// CachePolicy returns the CachePolicy of the layer.
+func (t *TileServer) CachePolicy(layer string) CachePolicy {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.policies[layer]
+}
@@ -0,0 +1,166 @@
+package maptiles
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestCachePolicy test serving fresh, stale and expired tiles.
+func TestCachePolicy(t *testing.T) {
+	var hits, broken int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&broken) != 0 {
+			http.Error(w, "down", http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(strconv.Itoa(int(atomic.AddInt32(&hits, 1)))))
+	}))
+	defer upstream.Close()
+	dir, err := ioutil.TempDir("", "maptiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := NewTileServer("", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddUpstreamLayer("osm", upstream.URL+"/{z}/{x}/{y}.png"); err != nil {
+		t.Fatal(err)
+	}
+	s.SetCachePolicy("osm", CachePolicy{MaxAge: time.Hour, StaleAge: 2 * time.Hour})
+
+	tc := TileCoord{X: 2, Y: 1, Zoom: 3, Layer: "osm", Format: "png"}
+	serve := func() string {
+		w := httptest.NewRecorder()
+		s.ServeTileRequest(w, httptest.NewRequest("GET", "/osm/3/2/1.png", nil), tc)
+		if w.Code != 200 {
+			t.Errorf("StatusCode: got %d; want %d", w.Code, 200)
+		}
+		return w.Body.String()
+	}
+	var m *TileDb
+	// Tiles are stored after the response
+	stored := func(want string) {
+		for i := 0; i < 100; i++ {
+			if m == nil {
+				m = s.tileDb("osm", "", "png", false)
+			}
+			if m != nil && string(fetchBlob(m, tc)) == want {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("tile %q not stored", want)
+	}
+	age := func(d time.Duration) {
+		if _, err := m.db.Exec("UPDATE layered_tiles SET updated_at=?", time.Now().Add(-d).Unix()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := serve(); got != "1" {
+		t.Errorf("new tile: got %q; want %q", got, "1")
+	}
+	stored("1")
+	if got, n := serve(), atomic.LoadInt32(&hits); got != "1" || n != 1 {
+		t.Errorf("fresh tile: got %q after %d upstream requests; want %q after 1", got, n, "1")
+	}
+
+	age(90 * time.Minute)
+	if got := serve(); got != "1" {
+		t.Errorf("stale tile: got %q; want %q", got, "1")
+	}
+	stored("2")
+
+	age(3 * time.Hour)
+	if got := serve(); got != "3" {
+		t.Errorf("expired tile: got %q; want %q", got, "3")
+	}
+	stored("3")
+
+	age(3 * time.Hour)
+	atomic.StoreInt32(&broken, 1)
+	if got := serve(); got != "3" {
+		t.Errorf("expired tile without upstream: got %q; want %q", got, "3")
+	}
+}
+
+// TestCacheHeaders test Cache-Control, Last-Modified and conditional
+// requests for rendered and cached tiles.
+func TestCacheHeaders(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("jpeg"))
+	}))
+	defer upstream.Close()
+	dir, err := ioutil.TempDir("", "maptiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := NewTileServer("", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddUpstreamLayer("sat", upstream.URL+"/{z}/{x}/{y}.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	s.SetCachePolicy("sat", CachePolicy{CacheControl: "public, max-age=60"})
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	get := func(header, value string) *http.Response {
+		req, _ := http.NewRequest("GET", ts.URL+"/sat/3/2/1.jpg", nil)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+	res := get("", "")
+	for _, path := range []string{"rendered", "cached"} {
+		if path == "cached" {
+			// Rendered tiles are stored after the response
+			for i := 0; i < 100; i++ {
+				if ok, _ := s.DbStore().Has(context.Background(), TileCoord{X: 2, Y: 1, Zoom: 3, Layer: "sat", Format: "jpeg"}); ok {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			res = get("", "")
+		}
+		want := map[string]string{
+			"Content-Type":  "image/jpeg",
+			"Cache-Control": "public, max-age=60",
+		}
+		for k, v := range want {
+			if got := res.Header.Get(k); got != v {
+				t.Errorf("%s %s: got %q; want %q", path, k, got, v)
+			}
+		}
+		etag, modified := res.Header.Get("ETag"), res.Header.Get("Last-Modified")
+		if etag == "" || modified == "" {
+			t.Errorf("%s: ETag %q, Last-Modified %q", path, etag, modified)
+		}
+		if res := get("If-None-Match", etag); res.StatusCode != http.StatusNotModified {
+			t.Errorf("%s If-None-Match: got %d; want %d", path, res.StatusCode, http.StatusNotModified)
+		}
+		if res := get("If-Modified-Since", modified); res.StatusCode != http.StatusNotModified {
+			t.Errorf("%s If-Modified-Since: got %d; want %d", path, res.StatusCode, http.StatusNotModified)
+		}
+		if res := get("If-Modified-Since", "Mon, 02 Jan 2006 15:04:05 GMT"); res.StatusCode != 200 {
+			t.Errorf("%s If-Modified-Since 2006: got %d; want %d", path, res.StatusCode, 200)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package maptiles
+
+import (
+	"strings"
+	"time"
+)
+
+// Deletes the blobs no tile refers to anymore.
+const gcQuery = "DELETE FROM tile_blobs WHERE checksum NOT IN (SELECT checksum FROM layered_tiles)"
+
+// PurgeFilter selects the tiles removed by Purge. Zero fields match all
+// tiles, so the zero PurgeFilter matches every tile of the file.
+type PurgeFilter struct {
+	Layer   string // "" means all layers
+	MinZoom uint64
+	MaxZoom uint64     // 0 means no upper limit
+	Bounds  [4]float64 // west, south, east, north in degrees, all zero means everywhere
+	// Only tiles stored before, zero means any age. Tiles of files written
+	// before timestamps were recorded are always older.
+	Before time.Time
+}
+
+// Purge removes the tiles matching f, including queued inserts, and
+// garbage-collects blobs no tile refers to anymore. It returns the number
+// of tiles removed.
+func (m *TileDb) Purge(f PurgeFilter) (int64, error) {
+	if err := m.Flush(); err != nil {
+		return 0, err
+	}
+	var where []string
+	var args []interface{}
+	if f.Layer != "" {
+		id, ok := m.layerId(f.Layer)
+		if !ok {
+			return 0, UnknownLayerError{f.Layer}
+		}
+		where = append(where, "layer_id=?")
+		args = append(args, id)
+	}
+	if !f.Before.IsZero() {
+		where = append(where, "(updated_at IS NULL OR updated_at<?)")
+		args = append(args, f.Before.Unix())
+	}
+
+	maxZoom := f.MaxZoom
+	if maxZoom == 0 || maxZoom >= uint64(len(gp.Ac)) {
+		maxZoom = uint64(len(gp.Ac)) - 1
+	}
+	type query struct {
+		where string
+		args  []interface{}
+	}
+	var queries []query
+	if f.Bounds == [4]float64{} {
+		w := append(where, "zoom_level>=?")
+		a := append(args, f.MinZoom)
+		if f.MaxZoom != 0 {
+			w = append(w, "zoom_level<=?")
+			a = append(a, f.MaxZoom)
+		}
+		queries = append(queries, query{strings.Join(w, " AND "), a})
+	} else {
+		// One range of columns and rows per zoom level
+		for z := f.MinZoom; z <= maxZoom; z++ {
+			x0, y0, x1, y1 := tileRange(f.Bounds, z)
+			w := append(where[:len(where):len(where)], "zoom_level=?", "tile_column BETWEEN ? AND ?", "tile_row BETWEEN ? AND ?")
+			a := append(args[:len(args):len(args)], z, x0, x1, y0, y1)
+			queries = append(queries, query{strings.Join(w, " AND "), a})
+		}
+	}
+
+	tx, err := m.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	for _, q := range queries {
+		res, err := tx.Exec("DELETE FROM layered_tiles WHERE "+q.where, q.args...)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		rows, _ := res.RowsAffected()
+		n += rows
+	}
+	if _, err := tx.Exec(gcQuery); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+// GC deletes the blobs no tile refers to anymore, e.g. after tiles were
+// replaced, and returns their number.
+func (m *TileDb) GC() (int64, error) {
+	res, err := m.db.Exec(gcQuery)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// tileRange returns the columns and the TMS rows of the tiles at zoom
+// that intersect bounds.
+func tileRange(bounds [4]float64, zoom uint64) (x0, y0, x1, y1 uint64) {
+	// top left and bottom right corner
+	px0 := fromLLtoPixel([2]float64{bounds[0], bounds[3]}, zoom)
+	px1 := fromLLtoPixel([2]float64{bounds[2], bounds[1]}, zoom)
+	max := uint64(1)<<zoom - 1
+	tile := func(p float64) uint64 {
+		if p <= 0 {
+			return 0
+		}
+		if t := uint64(p / 256); t < max {
+			return t
+		}
+		return max
+	}
+	x0, x1 = tile(px0[0]), tile(px1[0])
+	// XYZ rows grow southwards, TMS rows northwards
+	y0, y1 = max-tile(px1[1]), max-tile(px0[1])
+	return
+}
@@ -0,0 +1,63 @@
+package maptiles
+
+import (
+	"testing"
+	"time"
+)
+
+// TestPurge test removing tiles by layer, zoom, bounds and age.
+func TestPurge(t *testing.T) {
+	m, cleanup := tempTileDb(t)
+	defer cleanup()
+
+	// All 85 tiles of zoom 0 to 3 in two layers, with a blob per tile
+	for _, layer := range []string{"osm", "sat"} {
+		for z := uint64(0); z <= 3; z++ {
+			for x := uint64(0); x < 1<<z; x++ {
+				for y := uint64(0); y < 1<<z; y++ {
+					blob := []byte{byte(z), byte(x), byte(y), layer[0]}
+					m.InsertQueue() <- TileFetchResult{TileCoord{X: x, Y: y, Zoom: z, Layer: layer}, blob, nil}
+				}
+			}
+		}
+	}
+	count := func(query string) (n int64) {
+		if err := m.rdb.QueryRow(query).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	n, err := m.Purge(PurgeFilter{Layer: "sat", MinZoom: 2})
+	if err != nil || n != 16+64 {
+		t.Errorf("Purge by zoom: got %d, %v; want %d", n, err, 16+64)
+	}
+	if blobs := count("SELECT count(*) FROM tile_blobs"); blobs != 2*85-80 {
+		t.Errorf("blobs after Purge: got %d; want %d", blobs, 2*85-80)
+	}
+
+	// The north-western quarter of the world: 1 tile at zoom 1, 4 at zoom 2
+	n, err = m.Purge(PurgeFilter{Layer: "osm", MinZoom: 1, MaxZoom: 2, Bounds: [4]float64{-170, 10, -10, 80}})
+	if err != nil || n != 1+4 {
+		t.Errorf("Purge by bounds: got %d, %v; want %d", n, err, 1+4)
+	}
+	if blob := fetchBlob(m, TileCoord{X: 0, Y: 0, Zoom: 1, Layer: "osm"}); blob != nil {
+		t.Errorf("tile 1/0/0 not purged")
+	}
+	if blob := fetchBlob(m, TileCoord{X: 0, Y: 1, Zoom: 1, Layer: "osm"}); blob == nil {
+		t.Errorf("tile 1/0/1 purged")
+	}
+
+	if n, err := m.Purge(PurgeFilter{Before: time.Now().Add(-time.Hour)}); err != nil || n != 0 {
+		t.Errorf("Purge of old tiles: got %d, %v; want 0", n, err)
+	}
+	if n, err := m.Purge(PurgeFilter{Before: time.Now().Add(time.Second)}); err != nil || n != 2*85-80-5 {
+		t.Errorf("Purge of all tiles: got %d, %v; want %d", n, err, 2*85-80-5)
+	}
+	if blobs := count("SELECT count(*) FROM tile_blobs"); blobs != 0 {
+		t.Errorf("blobs after purging all tiles: got %d; want 0", blobs)
+	}
+	if _, err := m.Purge(PurgeFilter{Layer: "nosuchlayer"}); err == nil {
+		t.Error("Purge of unknown layer: no error")
+	}
+}
@@ -1,11 +1,15 @@
 package maptiles
 
 import (
-	"fmt"
+	"context"
+	"errors"
+	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -21,11 +25,40 @@ type TileCoord struct {
 type TileFetchResult struct {
 	Coord TileCoord
 	Blob  []byte
+	Err   error // why Blob is nil, e.g. ErrTileNotFound or *UpstreamError
 }
 
 type TileFetchRequest struct {
 	Coord   TileCoord
 	OutChan chan<- TileFetchResult
+	// Ctx cancels the request, nil means context.Background(). Cancelled
+	// requests are dropped without sending a result to OutChan.
+	Ctx context.Context
+}
+
+func (r TileFetchRequest) Context() context.Context {
+	if r.Ctx == nil {
+		return context.Background()
+	}
+	return r.Ctx
+}
+
+// reply sends result to r.OutChan unless r is cancelled first.
+func (r TileFetchRequest) reply(result TileFetchResult) {
+	select {
+	case r.OutChan <- result:
+	case <-r.Context().Done():
+	}
+}
+
+// valid reports whether c denotes a tile of the Web Mercator pyramid as
+// far as googleprojection.go can compute it.
+func (c TileCoord) valid() bool {
+	if c.Zoom >= uint64(len(gp.Ac)) {
+		return false
+	}
+	n := uint64(1) << c.Zoom
+	return c.X < n && c.Y < n
 }
 
 func (c *TileCoord) setTMS(tms bool) {
@@ -35,91 +68,182 @@ func (c *TileCoord) setTMS(tms bool) {
 	}
 }
 
+// Renderer produces the tile data for a TileCoord. TileRenderer proxies
+// an upstream tile server via HTTP, MapnikRenderer renders a Mapnik
+// stylesheet.
+type Renderer interface {
+	RenderTile(ctx context.Context, c TileCoord) ([]byte, error)
+}
+
 func NewTileRendererChan(stylesheet string) chan<- TileFetchRequest {
+	return NewRendererChan(NewTileRenderer(stylesheet))
+}
+
+// NewRendererChan serves the requests sent on the returned channel with r,
+// each in its own goroutine. Requests cancelled before their turn are
+// dropped. Once the channel is closed and all pending
+// requests are answered, r is closed if it implements io.Closer.
+func NewRendererChan(r Renderer) chan<- TileFetchRequest {
 	c := make(chan TileFetchRequest)
 
 	go func(requestChan <-chan TileFetchRequest) {
-		var err error
-		t := NewTileRenderer(stylesheet)
+		var wg sync.WaitGroup
 		for request := range requestChan {
-			go func(request TileFetchRequest, t *TileRenderer) {
-				result := TileFetchResult{request.Coord, nil}
-				result.Blob, err = t.RenderTile(request.Coord)
+			wg.Add(1)
+			go func(request TileFetchRequest) {
+				defer wg.Done()
+				ctx := request.Context()
+				if ctx.Err() != nil {
+					return
+				}
+				blob, err := r.RenderTile(ctx, request.Coord)
 				if err != nil {
 					// log.Println("Error while rendering", request.Coord, ":", err.Error())
-					result.Blob = nil
+					blob = nil
 				}
-				request.OutChan <- result
-			}(request, t)
+				request.reply(TileFetchResult{request.Coord, blob, err})
+			}(request)
+		}
+		wg.Wait()
+		if closer, ok := r.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				log.Println(err)
+			}
 		}
 	}(c)
 
 	return c
 }
 
-// Renders images as Web Mercator tiles
+// Proxies tiles from an upstream tile server, see RenderTileZXY.
 type TileRenderer struct {
 	m        string
-	no_retry int
+	upstream *UpstreamConfig
 }
 
 func NewTileRenderer(stylesheet string) *TileRenderer {
-	t := new(TileRenderer)
-	var err error
-	if err != nil {
-		log.Fatal(err)
-	}
-	t.no_retry = 3
+	return NewUpstreamRenderer(stylesheet, DefaultUpstreamConfig)
+}
+
+// NewTileRendererWithRetry creates a TileRenderer that retries failed
+// upstream requests according to retry.
+func NewTileRendererWithRetry(stylesheet string, retry RetryPolicy) *TileRenderer {
+	return NewUpstreamRenderer(stylesheet, &UpstreamConfig{Retry: retry})
+}
 
+// NewUpstreamRenderer creates a TileRenderer that fetches tiles as
+// configured by upstream. A nil upstream means DefaultUpstreamConfig.
+// If stylesheet (the URLTemplate of the upstream) is empty, the
+// TileCoord.Url of each request is used instead.
+func NewUpstreamRenderer(stylesheet string, upstream *UpstreamConfig) *TileRenderer {
+	if upstream == nil {
+		upstream = DefaultUpstreamConfig
+	}
+	t := new(TileRenderer)
+	t.m = stylesheet
+	t.upstream = upstream
 	return t
 }
 
-func (t *TileRenderer) RenderTile(c TileCoord) ([]byte, error) {
+func (t *TileRenderer) RenderTile(ctx context.Context, c TileCoord) ([]byte, error) {
+	if !c.valid() {
+		return nil, ErrInvalidCoord
+	}
 	c.setTMS(false)
-	return t.RenderTileZXY(c.Zoom, c.X, c.Y, c.Scale, c.Layer, c.Url, c.Format)
-}
-
-// Render a tile with coordinates in Google tile format.
-// Most upper left tile is always 0,0. Method is not thread-safe,
-// so wrap with a mutex when accessing the same renderer by multiple
-// threads or setup multiple goroutines and communicate with channels,
-// see NewTileRendererChan.
-func (t *TileRenderer) RenderTileZXY(zoom, x, y uint64, scale, layer, url, format string) ([]byte, error) {
-	tile_url := strings.Replace(url, "{z}", fmt.Sprintf("%d", zoom), 1)
-	tile_url = strings.Replace(tile_url, "{x}", fmt.Sprintf("%d", x), 1)
-	tile_url = strings.Replace(tile_url, "{y}", fmt.Sprintf("%d%s", y, scale), 1)
-	tile_url = strings.Replace(tile_url, "{layer}", layer, 1)
-	if format == "jpg" {
-		format = "jpeg"
+	url := t.m
+	if url == "" {
+		url = c.Url
 	}
-	tile_url = strings.Replace(tile_url, "{format}", format, 1)
-	// If sql error in datasource, Mapbox Studio resp.StatusCode=404
-	timeout := time.Duration(30 * time.Second)
-	client := http.Client{
-		Timeout: timeout,
+	return t.RenderTileZXY(ctx, c.Zoom, c.X, c.Y, c.Scale, c.Layer, url, c.Format)
+}
+
+// Render a tile with coordinates in Google tile format, url is an
+// URLTemplate. Most upper left tile is always 0,0. Failed requests are retried
+// according to the RetryPolicy of the renderer, the retries of one call
+// don't affect any other call. The upstream request is aborted when ctx
+// is cancelled.
+func (t *TileRenderer) RenderTileZXY(ctx context.Context, zoom, x, y uint64, scale, layer, url, format string) ([]byte, error) {
+	tmpl, err := ParseURLTemplate(url)
+	if err != nil {
+		return nil, err
 	}
-	var resp, err = client.Get(tile_url)
+	c := TileCoord{X: x, Y: y, Zoom: zoom, Layer: layer, Scale: scale, Format: format}
+	return t.get(ctx, tmpl.Expand(c, t.upstream.Subdomains))
+}
+
+// get fetches tile_url, retrying according to the RetryPolicy.
+func (t *TileRenderer) get(ctx context.Context, tile_url string) ([]byte, error) {
+	for n := 0; ; n++ {
+		blob, err := t.fetch(ctx, tile_url)
+		if err == nil {
+			return blob, nil
+		}
+		d, retry := t.upstream.Retry.delay(n, err)
+		if !retry || ctx.Err() != nil {
+			return nil, err
+		}
+		// log.Printf("Retry #%d, wait %d ms", n+1, d/time.Millisecond)
+		timer := time.NewTimer(d)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// fetch does a single GET of tile_url.
+func (t *TileRenderer) fetch(ctx context.Context, tile_url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", tile_url, nil)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode >= 400 && resp.StatusCode <= 499 {
-		return nil, fmt.Errorf("%d", http.StatusNotFound)
+	t.upstream.authorize(req)
+	resp, err := t.upstream.Client().Do(req)
+	if err != nil {
+		return nil, fetchError(ctx, tile_url, err)
 	}
-	// Only retry when "Error: Timed out after 5000ms" -- Assume Mapbox Studio
-	// processing tile in background and we can retry request later
-	// If reach this 5000ms error = candidate to refactor datasource
-	if t.no_retry > 0 && resp.StatusCode >= 500 && resp.StatusCode <= 599 {
-		ms := 500 * time.Millisecond
-		// log.Printf("Retry #%d, wait %d ms", t.no_retry, ms/time.Millisecond)
-		time.Sleep(ms)
-		t.no_retry = t.no_retry - 1
-		return t.RenderTileZXY(zoom, x, y, scale, layer, url, format)
+	defer func() {
+		// Drain error pages so the connection can be reused
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+		resp.Body.Close()
+	}()
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 && resp.StatusCode <= 599:
+		// Mapbox Studio answers 500 "Error: Timed out after 5000ms" while it
+		// is still processing the tile, worth another try.
+		retryAfter := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		return nil, &UpstreamError{URL: tile_url, StatusCode: resp.StatusCode, RetryAfter: retryAfter}
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone || resp.StatusCode == http.StatusNoContent:
+		// If sql error in datasource, Mapbox Studio resp.StatusCode=404
+		return nil, ErrTileNotFound
+	case resp.StatusCode >= 400 && resp.StatusCode <= 499:
+		// e.g. 401 or 403 for a wrong API key, a broken upstream rather
+		// than a missing tile, and not worth another try
+		return nil, &UpstreamError{URL: tile_url, StatusCode: resp.StatusCode}
+	case isServiceException(resp.Header.Get("Content-Type")):
+		// WMS servers report errors as XML documents with status 200
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, &UpstreamError{URL: tile_url, StatusCode: resp.StatusCode, Err: errors.New(strings.TrimSpace(string(msg)))}
 	}
-	if t.no_retry < 1 {
-		// log.Println("Giveup")
-		return nil, fmt.Errorf("Timeout from tile server")
+
+	// The client's timeout also covers the body read
+	blob, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fetchError(ctx, tile_url, err)
 	}
+	return blob, nil
+}
 
-	return ioutil.ReadAll(resp.Body)
+// fetchError tells a cancelled request and an upstream timeout from other
+// failures to get a response from tile_url.
+func fetchError(ctx context.Context, tile_url string, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return ErrUpstreamTimeout
+	}
+	return &UpstreamError{URL: tile_url, Err: err}
 }
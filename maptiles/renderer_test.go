@@ -1,19 +1,24 @@
 package maptiles
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 )
 
 var (
 	tsv *TileServer
-	// once used to make sure groupcache only assigned once,
-	// see https://github.com/golang/groupcache/blob/master/groupcache_test.go
+	// once creates the tsv shared by the tests against urltemplate
 	once        sync.Once
 	urltemplate string
 	cachedir    = "./"
@@ -28,7 +33,10 @@ func init() {
 }
 
 func tileserverSetup() {
-	tsv = NewTileServer(urltemplate, cachedir)
+	var err error
+	if tsv, err = NewTileServer(urltemplate, cachedir); err != nil {
+		panic(err)
+	}
 }
 
 // TestServerError test tile server source for Server Error.
@@ -41,6 +49,8 @@ func TestServerError(t *testing.T) {
 	log.Printf("Mock Mapbox Studio: %s", urltemplate)
 
 	once.Do(tileserverSetup)
+	// tsv is shared between tests, point it to this test's upstream
+	tsv.url = urltemplate
 	ts := httptest.NewServer(tsv)
 	defer ts.Close()
 
@@ -51,9 +61,9 @@ func TestServerError(t *testing.T) {
 		log.Fatal(err)
 	}
 	log.Info("StatusCode: ", res.StatusCode)
-	// Should be 500, but for now go-mapnik assume any TileFetchResult.Blob==nil is 404
-	if res.StatusCode != 404 {
-		t.Errorf("StatusCode: got %d; want %d", res.StatusCode, 404)
+	// Upstream server errors are reported as a bad gateway
+	if res.StatusCode != 502 {
+		t.Errorf("StatusCode: got %d; want %d", res.StatusCode, 502)
 	}
 	content, err := ioutil.ReadAll(res.Body)
 	res.Body.Close()
@@ -75,6 +85,8 @@ func TestNotFound(t *testing.T) {
 	log.Printf("Mock Mapbox Studio: %s", urltemplate)
 
 	once.Do(tileserverSetup)
+	// tsv is shared between tests, point it to this test's upstream
+	tsv.url = urltemplate
 	ts := httptest.NewServer(tsv)
 	defer ts.Close()
 
@@ -96,3 +108,457 @@ func TestNotFound(t *testing.T) {
 	log.Info("Content length: ", len(content))
 	log.Info("Content: ", string(content))
 }
+
+// TestRenderCancel test upstream fetches are aborted when the request is cancelled.
+func TestRenderCancel(t *testing.T) {
+	stalled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer stalled.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	lmp := NewLayerMultiplex()
+	lmp.AddRenderer("street", stalled.URL)
+	start := time.Now()
+	_, err := lmp.FetchTile(ctx, TileCoord{Layer: "street", Url: stalled.URL})
+	if err != context.DeadlineExceeded {
+		t.Errorf("FetchTile: got %v; want %v", err, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("FetchTile took %v after cancel", d)
+	}
+}
+
+// TestUpstreamTimeout test an upstream stalling in the middle of a tile
+// times out like one that doesn't answer at all.
+func TestUpstreamTimeout(t *testing.T) {
+	var hits int32
+	stalled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Header().Set("Content-Length", "1024")
+		w.Write([]byte("half a tile"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer stalled.Close()
+
+	cfg := &UpstreamConfig{Timeout: 50 * time.Millisecond, Retry: RetryPolicy{Attempts: 2, BaseDelay: time.Millisecond}}
+	tr := NewUpstreamRenderer("", cfg)
+	_, err := tr.RenderTile(context.Background(), TileCoord{Url: stalled.URL})
+	if err != ErrUpstreamTimeout {
+		t.Errorf("RenderTile: got %v; want %v", err, ErrUpstreamTimeout)
+	}
+	if got := httpStatus(err); got != http.StatusGatewayTimeout {
+		t.Errorf("httpStatus: got %d; want %d", got, http.StatusGatewayTimeout)
+	}
+	if n := atomic.LoadInt32(&hits); n != 2 {
+		t.Errorf("hits: got %d; want 2", n)
+	}
+}
+
+// TestRetryPolicy test failed upstream requests are retried per request,
+// unless the upstream refused them.
+func TestRetryPolicy(t *testing.T) {
+	var hits int32
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt32(&hits, 1) % 3 {
+		case 1:
+			w.Header().Set("Retry-After", "0")
+			http.Error(w, "Error: Timed out after 5000ms", http.StatusInternalServerError)
+		case 2:
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+		default:
+			w.Write([]byte("tile"))
+		}
+	}))
+	defer flaky.Close()
+
+	tr := NewTileRendererWithRetry("", RetryPolicy{Attempts: 3, BaseDelay: time.Millisecond})
+	tc := TileCoord{Url: flaky.URL}
+	// Each request gets its own three attempts
+	for i := 0; i < 3; i++ {
+		blob, err := tr.RenderTile(context.Background(), tc)
+		if err != nil || string(blob) != "tile" {
+			t.Fatalf("RenderTile #%d: got %q, %v; want %q", i, blob, err, "tile")
+		}
+	}
+	if hits != 9 {
+		t.Errorf("upstream hits: got %d; want %d", hits, 9)
+	}
+
+	tr = NewTileRendererWithRetry("", RetryPolicy{Attempts: 2, BaseDelay: time.Millisecond})
+	atomic.StoreInt32(&hits, 0)
+	_, err := tr.RenderTile(context.Background(), tc)
+	if _, ok := err.(*UpstreamError); !ok {
+		t.Errorf("RenderTile: got %v; want *UpstreamError", err)
+	}
+
+	// A wrong API key is a broken upstream, not a missing tile, and asking
+	// again does not help. Only 404, 410 and 204 mean no tile.
+	for _, code := range []int{http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusGone, http.StatusNoContent} {
+		atomic.StoreInt32(&hits, 0)
+		status := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&hits, 1)
+			w.WriteHeader(code)
+		}))
+		tr = NewTileRendererWithRetry("", RetryPolicy{Attempts: 3, BaseDelay: time.Millisecond})
+		_, err := tr.RenderTile(context.Background(), TileCoord{Url: status.URL})
+		status.Close()
+		want := http.StatusBadGateway
+		if code == http.StatusNotFound || code == http.StatusGone || code == http.StatusNoContent {
+			want = http.StatusNotFound
+		}
+		if got := httpStatus(err); got != want {
+			t.Errorf("upstream %d: got %v, status %d; want %d", code, err, got, want)
+		}
+		if n := atomic.LoadInt32(&hits); n != 1 {
+			t.Errorf("upstream %d: got %d requests; want 1", code, n)
+		}
+	}
+}
+
+// TestUpstreamConfig test configured headers and credentials reach the upstream.
+func TestUpstreamConfig(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer secret" {
+			t.Errorf("Authorization: got %q; want %q", got, "Bearer secret")
+		}
+		if got := r.UserAgent(); got != "go-mapnik-test" {
+			t.Errorf("User-Agent: got %q; want %q", got, "go-mapnik-test")
+		}
+		w.Write([]byte("tile"))
+	}))
+	defer upstream.Close()
+
+	cfg := &UpstreamConfig{
+		Header:          http.Header{"User-Agent": {"go-mapnik-test"}},
+		BearerToken:     "secret",
+		MaxConnsPerHost: 2,
+	}
+	a := NewUpstreamRenderer("", cfg)
+	b := NewUpstreamRenderer("", cfg)
+	for _, tr := range []*TileRenderer{a, b} {
+		if _, err := tr.RenderTile(context.Background(), TileCoord{Url: upstream.URL}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if a.upstream.Client() != b.upstream.Client() {
+		t.Error("renderers with the same config use different clients")
+	}
+}
+
+// TestTileJSON test TileJSON documents for registered layers.
+func TestTileJSON(t *testing.T) {
+	once.Do(tileserverSetup)
+	ts := httptest.NewServer(tsv)
+	defer ts.Close()
+
+	if err := tsv.AddUpstreamLayer("admin", "http://upstream/{z}/{x}/{y}.png"); err != nil {
+		t.Fatal(err)
+	}
+	tsv.SetLayerInfo("admin", LayerInfo{Attribution: "(c) admin", MaxZoom: 12})
+
+	var tj TileJSON
+	res, err := http.Get(ts.URL + "/admin.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.NewDecoder(res.Body).Decode(&tj)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := ts.URL + "/admin/{z}/{x}/{y}.png"; len(tj.Tiles) != 1 || tj.Tiles[0] != want {
+		t.Errorf("tiles: got %v; want %q", tj.Tiles, want)
+	}
+	if tj.MaxZoom != 12 || tj.Attribution != "(c) admin" || tj.Name != "admin" {
+		t.Errorf("TileJSON: got %+v", tj)
+	}
+
+	var index []TileJSON
+	res, err = http.Get(ts.URL + "/layers.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.NewDecoder(res.Body).Decode(&index)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, tj := range index {
+		found = found || tj.Name == "admin"
+	}
+	if !found {
+		t.Errorf("layers.json: admin missing in %+v", index)
+	}
+
+	// Layer names as allowed by the tile patterns
+	if err := tsv.AddUpstreamLayer("admin_2", "http://upstream/{z}/{x}/{y}.png"); err != nil {
+		t.Fatal(err)
+	}
+	res, err = http.Get(ts.URL + "/admin_2.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("admin_2.json StatusCode: got %d; want %d", res.StatusCode, 200)
+	}
+
+	res, err = http.Get(ts.URL + "/nosuchlayer.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 404 {
+		t.Errorf("StatusCode: got %d; want %d", res.StatusCode, 404)
+	}
+}
+
+// TestLayerIndexProxied test layers.json leaves out the layers a proxying
+// server adds for any name asked for.
+func TestLayerIndexProxied(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("tile"))
+	}))
+	defer upstream.Close()
+	dir, err := ioutil.TempDir("", "maptiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sv, err := NewTileServer(upstream.URL+"/{z}/{x}/{y}.png", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(sv)
+	defer ts.Close()
+
+	sv.SetLayerInfo("street", LayerInfo{Attribution: "(c) street"})
+	for _, layer := range []string{"street", "junk"} {
+		res, err := http.Get(ts.URL + "/" + layer + "/1/0/0.png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != 200 {
+			t.Errorf("%s StatusCode: got %d; want %d", layer, res.StatusCode, 200)
+		}
+	}
+
+	var index []TileJSON
+	res, err := http.Get(ts.URL + "/layers.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.NewDecoder(res.Body).Decode(&index)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(index) != 1 || index[0].Name != "street" {
+		t.Errorf("layers.json: got %+v; want street only", index)
+	}
+	// The cache file of street says nothing about the layer
+	if len(index) == 1 && index[0].Description != "" {
+		t.Errorf("Description: got %q; want none", index[0].Description)
+	}
+}
+
+// TestLayerBounds test that invalid and out of bounds tiles never reach
+// the upstream.
+func TestLayerBounds(t *testing.T) {
+	var hits int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Write([]byte("png"))
+	}))
+	defer upstream.Close()
+	dir, err := ioutil.TempDir("", "maptiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tsv, err := NewTileServer("", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(tsv)
+	defer ts.Close()
+
+	if err := tsv.AddUpstreamLayer("bounded", upstream.URL+"/{z}/{x}/{y}.png"); err != nil {
+		t.Fatal(err)
+	}
+	// Roughly Germany
+	tsv.SetLayerInfo("bounded", LayerInfo{MinZoom: 2, MaxZoom: 10, Bounds: [4]float64{5.8, 47.2, 15.1, 55.1}})
+	tsv.SetLayerInfo("bounded-empty", LayerInfo{MaxZoom: 10, EmptyTile: []byte("empty")})
+	if err := tsv.AddUpstreamLayer("bounded-empty", upstream.URL+"/{z}/{x}/{y}.png"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path string
+		code int
+		body string
+	}{
+		{"/bounded/1/2/0.png", 400, ""},
+		{"/bounded/1/0/0.png", 404, ""},
+		{"/bounded/11/1070/660.png", 404, ""},
+		{"/bounded/5/0/0.png", 404, ""},
+		{"/bounded-empty/11/0/0.png", 200, "empty"},
+	}
+	for _, test := range tests {
+		res, err := http.Get(ts.URL + test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != test.code || (test.body != "" && string(body) != test.body) {
+			t.Errorf("%s: got %d %q; want %d %q", test.path, res.StatusCode, body, test.code, test.body)
+		}
+	}
+	if n := atomic.LoadInt32(&hits); n != 0 {
+		t.Errorf("upstream requests: got %d; want 0", n)
+	}
+
+	res, err := http.Get(ts.URL + "/bounded/5/16/10.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if n := atomic.LoadInt32(&hits); res.StatusCode != 200 || n != 1 {
+		t.Errorf("tile within bounds: got %d after %d upstream requests", res.StatusCode, n)
+	}
+}
+
+// TestRenderCoalescing test that concurrent and sequential requests for
+// the same tile share one upstream fetch.
+func TestRenderCoalescing(t *testing.T) {
+	var hits int32
+	release := make(chan bool)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		<-release
+		w.Write([]byte("png"))
+	}))
+	defer upstream.Close()
+	dir, err := ioutil.TempDir("", "maptiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tsv, err := NewTileServer("", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(tsv)
+	defer ts.Close()
+	if err := tsv.AddUpstreamLayer("coalesced", upstream.URL+"/{z}/{x}/{y}.png"); err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 5
+	before := tsv.RenderStats()
+	var wg sync.WaitGroup
+	codes := make(chan int, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := http.Get(ts.URL + "/coalesced/3/2/1.png")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			res.Body.Close()
+			codes <- res.StatusCode
+		}()
+	}
+	for tsv.RenderStats().Coalesced-before.Coalesced < n-1 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	close(codes)
+	for code := range codes {
+		if code != 200 {
+			t.Errorf("StatusCode: got %d; want %d", code, 200)
+		}
+	}
+	if got := atomic.LoadInt32(&hits); got != 1 {
+		t.Errorf("upstream requests: got %d; want 1", got)
+	}
+	if s := tsv.RenderStats(); s.Fetches-before.Fetches != 1 {
+		t.Errorf("Fetches: got %d; want 1", s.Fetches-before.Fetches)
+	}
+
+	// Requests right after the fetch must neither miss the tile while it is
+	// queued for the cache file nor fetch it again
+	for i := 0; i < 3; i++ {
+		res, err := http.Get(ts.URL + "/coalesced/3/2/2.png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != 200 {
+			t.Errorf("StatusCode: got %d; want %d", res.StatusCode, 200)
+		}
+	}
+	if got := atomic.LoadInt32(&hits); got != 2 {
+		t.Errorf("upstream requests: got %d; want 2", got)
+	}
+}
+
+// TestUpstreamTemplate test the upstream url of a TileServer is checked
+// up front and its layers are registered once.
+func TestUpstreamTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maptiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if _, err := NewTileServer("http://tiles/{z}/{col}/{y}.png", dir); err == nil {
+		t.Error("NewTileServer: invalid url template accepted")
+	}
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("png"))
+	}))
+	defer upstream.Close()
+	s, err := NewTileServer(upstream.URL+"/{z}/{x}/{y}.png", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(x int) {
+			defer wg.Done()
+			res, err := http.Get(fmt.Sprintf("%s/auto/3/%d/1.png", ts.URL, x))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			res.Body.Close()
+			if res.StatusCode != 200 {
+				t.Errorf("StatusCode: got %d; want %d", res.StatusCode, 200)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	empty, err := NewTileServer("", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	empty.ServeHTTP(w, httptest.NewRequest("GET", "/auto/3/2/1.png", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("layer without upstream: got %d; want %d", w.Code, http.StatusNotFound)
+	}
+}
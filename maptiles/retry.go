@@ -0,0 +1,89 @@
+package maptiles
+
+import (
+	"errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy controls how often and how patiently a TileRenderer repeats
+// a failed upstream request. Timeouts, connection errors, 5xx and 429
+// responses are retried, a missing tile is not.
+type RetryPolicy struct {
+	Attempts  int           // total number of tries, values < 1 mean 1
+	BaseDelay time.Duration // delay before the first retry, doubled for each further retry
+	MaxDelay  time.Duration // upper limit for a single delay, also caps Retry-After
+}
+
+// Assume Mapbox Studio is processing the tile in background when it
+// answers "Error: Timed out after 5000ms", so retry a few times.
+var DefaultRetryPolicy = RetryPolicy{
+	Attempts:  4,
+	BaseDelay: 500 * time.Millisecond,
+	MaxDelay:  10 * time.Second,
+}
+
+func (p RetryPolicy) attempts() int {
+	if p.Attempts < 1 {
+		return 1
+	}
+	return p.Attempts
+}
+
+// backoff returns the delay before retry number n (starting at 0): the
+// exponential delay with its upper half randomized, so that clients that
+// failed together do not retry together.
+func (p RetryPolicy) backoff(n int) time.Duration {
+	d := p.BaseDelay
+	for i := 0; i < n && (p.MaxDelay <= 0 || d < p.MaxDelay); i++ {
+		d *= 2
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1))
+}
+
+// delay returns how long to wait after err before retry number n, or false
+// if err is not worth retrying.
+func (p RetryPolicy) delay(n int, err error) (time.Duration, bool) {
+	if n+1 >= p.attempts() {
+		return 0, false
+	}
+	var upstream *UpstreamError
+	switch {
+	case errors.Is(err, ErrUpstreamTimeout):
+		return p.backoff(n), true
+	case errors.As(err, &upstream) && upstream.temporary():
+		d := p.backoff(n)
+		if upstream.RetryAfter > d {
+			d = upstream.RetryAfter
+			if p.MaxDelay > 0 && d > p.MaxDelay {
+				d = p.MaxDelay
+			}
+		}
+		return d, true
+	}
+	return 0, false
+}
+
+// parseRetryAfter reads the Retry-After header, given either in seconds
+// or as HTTP date.
+func parseRetryAfter(h string, now time.Time) time.Duration {
+	if h == "" {
+		return 0
+	}
+	if s, err := strconv.Atoi(h); err == nil && s > 0 {
+		return time.Duration(s) * time.Second
+	}
+	if t, err := http.ParseTime(h); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
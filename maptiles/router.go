@@ -0,0 +1,162 @@
+package maptiles
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Path patterns understood by ParseTilePattern. Tokens are {layer}, {z},
+// {x}, {y} or {-y} for TMS rows, {scale} for the digits of a retina
+// suffix and {ext} for the tile format.
+const (
+	XYZPattern      = "/{layer}/{z}/{x}/{y}.{ext}"
+	XYZScalePattern = "/{layer}/{z}/{x}/{y}@{scale}x.{ext}"
+	TMSPattern      = "/{layer}/{z}/{x}/{-y}.{ext}"
+)
+
+// Used by ServeHTTP, equivalent to the paths served before patterns
+// were configurable.
+var DefaultTilePatterns = []string{XYZScalePattern, XYZPattern}
+
+var tilePatternTokens = map[string]string{
+	"layer": `[-A-Za-z0-9_]+`,
+	"z":     `[0-9]+`,
+	"x":     `[0-9]+`,
+	"y":     `[0-9]+`,
+	"-y":    `[0-9]+`,
+	"scale": `[0-9]+`,
+	"ext":   `png[0-9]{0,3}|jpe?g1?[0-9]{0,2}|(?:vector\.)?pbf`,
+}
+
+// Compiled request path pattern, see ParseTilePattern.
+type TilePattern struct {
+	raw   string
+	re    *regexp.Regexp
+	names []string // token of each submatch
+}
+
+// ParseTilePattern compiles a path pattern such as XYZPattern. Patterns
+// match the end of the request path, so a router may mount them below a
+// prefix. {layer}, {z}, {x}, one of {y} and {-y} and {ext} are required.
+func ParseTilePattern(pattern string) (*TilePattern, error) {
+	p := &TilePattern{raw: pattern}
+	var expr strings.Builder
+	seen := make(map[string]bool)
+	rest := pattern
+	for {
+		open := strings.IndexByte(rest, '{')
+		if open < 0 {
+			expr.WriteString(regexp.QuoteMeta(rest))
+			break
+		}
+		n := strings.IndexByte(rest[open:], '}')
+		if n < 0 {
+			return nil, fmt.Errorf("maptiles: tile pattern %q: unclosed '{'", pattern)
+		}
+		token := rest[open+1 : open+n]
+		re, ok := tilePatternTokens[token]
+		if !ok || seen[token] {
+			return nil, fmt.Errorf("maptiles: tile pattern %q: unknown or repeated token {%s}", pattern, token)
+		}
+		seen[token] = true
+		expr.WriteString(regexp.QuoteMeta(rest[:open]))
+		expr.WriteString("(" + re + ")")
+		p.names = append(p.names, token)
+		rest = rest[open+n+1:]
+	}
+	if !seen["layer"] || !seen["z"] || !seen["x"] || seen["y"] == seen["-y"] || !seen["ext"] {
+		return nil, fmt.Errorf("maptiles: tile pattern %q: needs {layer}, {z}, {x}, {y} or {-y} and {ext}", pattern)
+	}
+	var err error
+	p.re, err = regexp.Compile(expr.String() + "$")
+	return p, err
+}
+
+func (p *TilePattern) String() string {
+	return p.raw
+}
+
+// Match parses path into a new TileCoord. The Format is the extension as
+// found in the path. It returns ErrTileNotFound if path doesn't match and
+// ErrInvalidCoord if a number is out of range.
+func (p *TilePattern) Match(path string) (TileCoord, error) {
+	var c TileCoord
+	m := p.re.FindStringSubmatch(path)
+	if m == nil {
+		return c, ErrTileNotFound
+	}
+	for i, token := range p.names {
+		v := m[i+1]
+		var err error
+		switch token {
+		case "layer":
+			c.Layer = v
+		case "z":
+			c.Zoom, err = strconv.ParseUint(v, 10, 64)
+		case "x":
+			c.X, err = strconv.ParseUint(v, 10, 64)
+		case "y":
+			c.Y, err = strconv.ParseUint(v, 10, 64)
+		case "-y":
+			c.Y, err = strconv.ParseUint(v, 10, 64)
+			c.Tms = true
+		case "scale":
+			if v != "1" {
+				c.Scale = "@" + v + "x"
+			}
+		case "ext":
+			c.Format = v
+		}
+		if err != nil {
+			return c, ErrInvalidCoord
+		}
+	}
+	return c, nil
+}
+
+// TileRequestParser extracts the requested tile from r, e.g. from the
+// path variables of a router. It returns ErrTileNotFound for requests
+// that don't denote a tile.
+type TileRequestParser func(r *http.Request) (TileCoord, error)
+
+// PatternParser parses the request path with the first matching pattern.
+func PatternParser(patterns ...string) (TileRequestParser, error) {
+	var ps []*TilePattern
+	for _, pattern := range patterns {
+		p, err := ParseTilePattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		ps = append(ps, p)
+	}
+	return func(r *http.Request) (TileCoord, error) {
+		for _, p := range ps {
+			c, err := p.Match(r.URL.Path)
+			if err != ErrTileNotFound {
+				return c, err
+			}
+		}
+		return TileCoord{}, ErrTileNotFound
+	}, nil
+}
+
+// Handler serves tiles for the requests parse understands, for example
+//
+//	parse, _ := maptiles.PatternParser(maptiles.TMSPattern)
+//	mux.Handle("/tms/", http.StripPrefix("/tms", t.Handler(parse)))
+//
+// Every request gets its own TileCoord, so handlers for different
+// patterns can be used concurrently.
+func (t *TileServer) Handler(parse TileRequestParser) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tc, err := parse(r)
+		if err != nil {
+			tileError(w, err)
+			return
+		}
+		t.serveTile(w, r, tc)
+	})
+}
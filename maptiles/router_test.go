@@ -0,0 +1,44 @@
+package maptiles
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+// TestTilePattern test parsing request paths with the path patterns.
+func TestTilePattern(t *testing.T) {
+	parse, err := PatternParser(XYZScalePattern, XYZPattern)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path string
+		want TileCoord
+		err  error
+	}{
+		{"/osm/3/4/5.png", TileCoord{X: 4, Y: 5, Zoom: 3, Layer: "osm", Format: "png"}, nil},
+		{"/tiles/osm/3/4/5@2x.jpg", TileCoord{X: 4, Y: 5, Zoom: 3, Layer: "osm", Scale: "@2x", Format: "jpg"}, nil},
+		{"/osm/3/4/5@1x.vector.pbf", TileCoord{X: 4, Y: 5, Zoom: 3, Layer: "osm", Format: "vector.pbf"}, nil},
+		{"/osm/3/4/5.gif", TileCoord{}, ErrTileNotFound},
+		{"/osm/3/4/99999999999999999999.png", TileCoord{}, ErrInvalidCoord},
+	}
+	for _, test := range tests {
+		c, err := parse(httptest.NewRequest("GET", test.path, nil))
+		if err != test.err || (err == nil && c != test.want) {
+			t.Errorf("%s: got %+v, %v; want %+v, %v", test.path, c, err, test.want, test.err)
+		}
+	}
+
+	p, err := ParseTilePattern("/tms/{layer}/{z}/{x}/{-y}.{ext}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, err := p.Match("/tms/osm/1/0/1.png"); err != nil || !c.Tms || c.Y != 1 {
+		t.Errorf("TMS: got %+v, %v; want TMS row 1", c, err)
+	}
+	for _, pattern := range []string{"/{layer}/{z}/{x}.{ext}", "/{layer}/{z}/{x}/{y}/{-y}.{ext}", "/{layer}/{z}/{x}/{y}.{png}", "/{layer"} {
+		if _, err := ParseTilePattern(pattern); err == nil {
+			t.Errorf("ParseTilePattern(%q): invalid pattern accepted", pattern)
+		}
+	}
+}
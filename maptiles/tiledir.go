@@ -0,0 +1,149 @@
+package maptiles
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TileDirOptions controls ExportDir and ImportDir. Tile directories are
+// laid out as dir/z/x/y.ext.
+type TileDirOptions struct {
+	Layer string // layer in the TileDb, "" means the default layer
+	Tms   bool   // rows are numbered from the south as in TMS, not as in XYZ
+	Ext   string // file extension, "" means the format from the metadata or png
+	// Export identical tiles, e.g. empty sea tiles, as hardlinks to one file
+	Hardlink bool
+}
+
+// dirLayer returns the id and name of the layer to export or import. A
+// missing layer is created if create is set, else it is an
+// UnknownLayerError.
+func (m *TileDb) dirLayer(opt TileDirOptions, create bool) (int, string, error) {
+	name := opt.Layer
+	if name == "" {
+		var err error
+		if name, err = m.DefaultLayer(); err != nil {
+			return 0, "", err
+		}
+	}
+	if create {
+		id, err := m.ensureLayer(name)
+		return id, name, err
+	}
+	id, ok := m.layerId(name)
+	if !ok {
+		return 0, "", UnknownLayerError{name}
+	}
+	return id, name, nil
+}
+
+func (m *TileDb) dirExt(opt TileDirOptions) string {
+	if opt.Ext != "" {
+		return strings.TrimPrefix(opt.Ext, ".")
+	}
+	var format string
+	if err := m.rdb.QueryRow("SELECT value FROM metadata WHERE name='format'").Scan(&format); err == nil && format != "" {
+		return format
+	}
+	return "png"
+}
+
+// ExportDir writes all committed tiles of a layer to files below dir,
+// replacing existing files, and returns the number of tiles written.
+func (m *TileDb) ExportDir(dir string, opt TileDirOptions) (int, error) {
+	id, _, err := m.dirLayer(opt, false)
+	if err != nil {
+		return 0, err
+	}
+	ext := m.dirExt(opt)
+	rows, err := m.rdb.Query(`
+		SELECT layered_tiles.zoom_level, layered_tiles.tile_column, layered_tiles.tile_row, layered_tiles.checksum, tile_blobs.tile_data
+		FROM layered_tiles JOIN tile_blobs ON tile_blobs.checksum=layered_tiles.checksum
+		WHERE layered_tiles.layer_id=?`, id)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	// first file written for each checksum
+	files := make(map[string]string)
+	n := 0
+	for rows.Next() {
+		c := TileCoord{Tms: true}
+		var checksum string
+		var blob []byte
+		if err := rows.Scan(&c.Zoom, &c.X, &c.Y, &checksum, &blob); err != nil {
+			return n, err
+		}
+		c.setTMS(opt.Tms)
+		fn := filepath.Join(dir, strconv.FormatUint(c.Zoom, 10), strconv.FormatUint(c.X, 10), strconv.FormatUint(c.Y, 10)+"."+ext)
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			return n, err
+		}
+		if first, ok := files[checksum]; ok && opt.Hardlink {
+			os.Remove(fn)
+			if err := os.Link(first, fn); err == nil {
+				n++
+				continue
+			}
+			// e.g. not supported by the file system, write a copy instead
+		}
+		// Files of an earlier export may be hardlinks of each other
+		if err := writeTileFile(fn, blob, time.Time{}); err != nil {
+			return n, err
+		}
+		if _, ok := files[checksum]; !ok {
+			files[checksum] = fn
+		}
+		n++
+	}
+	return n, rows.Err()
+}
+
+// ImportDir stores the tiles found below dir in a layer, which is created
+// if needed, and returns their number. Files not named like dir/z/x/y.ext are skipped.
+func (m *TileDb) ImportDir(dir string, opt TileDirOptions) (int, error) {
+	_, layer, err := m.dirLayer(opt, true)
+	if err != nil {
+		return 0, err
+	}
+	ext := "." + m.dirExt(opt)
+	n := 0
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !strings.HasSuffix(path, ext) {
+			return err
+		}
+		rel, err := filepath.Rel(dir, strings.TrimSuffix(path, ext))
+		if err != nil {
+			return err
+		}
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		if len(parts) != 3 {
+			return nil
+		}
+		c := TileCoord{Layer: layer, Tms: opt.Tms}
+		for i, v := range []*uint64{&c.Zoom, &c.X, &c.Y} {
+			if *v, err = strconv.ParseUint(parts[i], 10, 64); err != nil {
+				return nil
+			}
+		}
+		if !c.valid() {
+			return nil
+		}
+		blob, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		m.InsertQueue() <- TileFetchResult{c, canonicalTile(ext, blob), nil}
+		n++
+		return nil
+	})
+	if ferr := m.Flush(); err == nil {
+		err = ferr
+	}
+	return n, err
+}
@@ -0,0 +1,91 @@
+package maptiles
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestTileDir test exporting a layer to a tile directory, also again, and
+// importing it.
+func TestTileDir(t *testing.T) {
+	m, cleanup := tempTileDb(t)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "tiledir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sea1 := TileCoord{X: 0, Y: 0, Zoom: 1, Layer: "osm"}
+	sea2 := TileCoord{X: 1, Y: 0, Zoom: 1, Layer: "osm"}
+	land := TileCoord{X: 1, Y: 1, Zoom: 1, Layer: "osm"}
+	m.InsertQueue() <- TileFetchResult{sea1, []byte("sea"), nil}
+	m.InsertQueue() <- TileFetchResult{sea2, []byte("sea"), nil}
+	m.InsertQueue() <- TileFetchResult{land, []byte("land"), nil}
+	if err := m.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := m.ExportDir(dir, TileDirOptions{Layer: "osm", Hardlink: true})
+	if err != nil || n != 3 {
+		t.Fatalf("ExportDir: got %d, %v; want 3 tiles", n, err)
+	}
+	blob, err := ioutil.ReadFile(filepath.Join(dir, "1", "1", "1.png"))
+	if err != nil || string(blob) != "land" {
+		t.Errorf("1/1/1.png: got %q, %v; want %q", blob, err, "land")
+	}
+	fi1, err1 := os.Stat(filepath.Join(dir, "1", "0", "0.png"))
+	fi2, err2 := os.Stat(filepath.Join(dir, "1", "1", "0.png"))
+	if err1 != nil || err2 != nil || !os.SameFile(fi1, fi2) {
+		t.Errorf("duplicate tiles not hardlinked: %v, %v", err1, err2)
+	}
+
+	// Exporting again must not write through the hardlinks
+	if err := m.Put(context.Background(), sea1, []byte("wave")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.ExportDir(dir, TileDirOptions{Layer: "osm"}); err != nil {
+		t.Fatal(err)
+	}
+	if blob, _ := ioutil.ReadFile(filepath.Join(dir, "1", "0", "0.png")); string(blob) != "wave" {
+		t.Errorf("1/0/0.png exported again: got %q; want %q", blob, "wave")
+	}
+	if blob, _ := ioutil.ReadFile(filepath.Join(dir, "1", "1", "0.png")); string(blob) != "sea" {
+		t.Errorf("1/1/0.png after exporting 1/0/0.png again: got %q; want %q", blob, "sea")
+	}
+
+	var unknown UnknownLayerError
+	if _, err := m.ExportDir(dir, TileDirOptions{Layer: "osn"}); !errors.As(err, &unknown) {
+		t.Errorf("ExportDir of a missing layer: got %v; want UnknownLayerError", err)
+	}
+	if _, ok := m.layerId("osn"); ok {
+		t.Error("ExportDir created the missing layer")
+	}
+
+	tms, err := ioutil.TempDir("", "tiledir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tms)
+	if _, err := m.ExportDir(tms, TileDirOptions{Layer: "osm", Tms: true}); err != nil {
+		t.Fatal(err)
+	}
+	if blob, _ := ioutil.ReadFile(filepath.Join(tms, "1", "1", "0.png")); string(blob) != "land" {
+		t.Errorf("TMS 1/1/0.png: got %q; want %q", blob, "land")
+	}
+
+	imported, cleanup2 := tempTileDb(t)
+	defer cleanup2()
+	ioutil.WriteFile(filepath.Join(tms, "README"), []byte("not a tile"), 0644)
+	n, err = imported.ImportDir(tms, TileDirOptions{Layer: "osm", Tms: true})
+	if err != nil || n != 3 {
+		t.Fatalf("ImportDir: got %d, %v; want 3 tiles", n, err)
+	}
+	if blob := fetchBlob(imported, land); string(blob) != "land" {
+		t.Errorf("imported tile: got %q; want %q", blob, "land")
+	}
+}
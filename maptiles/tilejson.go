@@ -0,0 +1,208 @@
+package maptiles
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// LayerInfo describes a layer for TileJSON documents. Zero values are
+// filled in from the metadata of the layer's cache file, see TileJSON.
+// MinZoom, MaxZoom and Bounds also limit the tiles the TileServer serves
+// for the layer, requests outside get EmptyTile or 404 Not Found.
+type LayerInfo struct {
+	Name        string // human readable name, defaults to the layer name
+	Description string
+	Attribution string
+	Format      string // file extension of the tiles: png (default), jpg or pbf
+	MinZoom     uint64
+	MaxZoom     uint64     // 0 means unset
+	Bounds      [4]float64 // west, south, east, north in degrees, all zero means unset
+	Center      [3]float64 // longitude, latitude, zoom, all zero means unset
+	EmptyTile   []byte     // served outside the zoom range and bounds, nil means 404
+}
+
+// contains reports whether the tile c lies within the zoom range and
+// intersects the bounds.
+func (info LayerInfo) contains(c TileCoord) bool {
+	if c.Zoom < info.MinZoom || (info.MaxZoom != 0 && c.Zoom > info.MaxZoom) {
+		return false
+	}
+	if info.Bounds == [4]float64{} {
+		return true
+	}
+	c.setTMS(false)
+	b := tileToLLBBox(c.Zoom, c.X, c.Y)
+	return b[0] < info.Bounds[2] && b[2] > info.Bounds[0] &&
+		b[1] < info.Bounds[3] && b[3] > info.Bounds[1]
+}
+
+// TileJSON 2.2.0/3.0.0 document, see https://github.com/mapbox/tilejson-spec
+type TileJSON struct {
+	TileJSON     string          `json:"tilejson"`
+	Name         string          `json:"name,omitempty"`
+	Description  string          `json:"description,omitempty"`
+	Attribution  string          `json:"attribution,omitempty"`
+	Scheme       string          `json:"scheme"`
+	Tiles        []string        `json:"tiles"`
+	MinZoom      uint64          `json:"minzoom"`
+	MaxZoom      uint64          `json:"maxzoom"`
+	Bounds       []float64       `json:"bounds,omitempty"`
+	Center       []float64       `json:"center,omitempty"`
+	Format       string          `json:"format,omitempty"`
+	VectorLayers json.RawMessage `json:"vector_layers,omitempty"`
+}
+
+// SetLayerInfo describes the layer name for its TileJSON document.
+func (t *TileServer) SetLayerInfo(name string, info LayerInfo) {
+	t.lmp.SetLayerInfo(name, info)
+}
+
+// TileJSON describes the registered layer. Fields of its LayerInfo take
+// precedence over the metadata table of the layer's cache file. Tile URLs
+// are absolute, based on the host r was sent to.
+func (t *TileServer) TileJSON(r *http.Request, layer string) (*TileJSON, error) {
+	if !t.lmp.HasLayer(layer) {
+		return nil, UnknownLayerError{layer}
+	}
+	info, _ := t.lmp.LayerInfo(layer)
+	if info.Format == "" {
+		info.Format = "png"
+	}
+	tj := &TileJSON{
+		TileJSON: "2.2.0",
+		Name:     layer,
+		Scheme:   "xyz",
+		MinZoom:  0,
+		MaxZoom:  22,
+		Bounds:   []float64{-180, -85.0511, 180, 85.0511},
+		Format:   info.Format,
+	}
+	if t.TmsSchema {
+		tj.Scheme = "tms"
+	}
+
+	format := info.Format
+	if format == "pbf" {
+		format = "vector.pbf"
+	}
+	format = strings.Replace(format, "jpg", "jpeg", 1)
+	if m := t.tileDb(layer, "", format, false); m != nil {
+		md, err := m.ReadMetadata()
+		if err != nil {
+			return nil, err
+		}
+		tj.applyMetadata(md)
+	}
+
+	if info.Name != "" {
+		tj.Name = info.Name
+	}
+	if info.Description != "" {
+		tj.Description = info.Description
+	}
+	if info.Attribution != "" {
+		tj.Attribution = info.Attribution
+	}
+	if info.MinZoom != 0 {
+		tj.MinZoom = info.MinZoom
+	}
+	if info.MaxZoom != 0 {
+		tj.MaxZoom = info.MaxZoom
+	}
+	if info.Bounds != [4]float64{} {
+		tj.Bounds = info.Bounds[:]
+	}
+	if info.Center != [3]float64{} {
+		tj.Center = info.Center[:]
+	}
+	if tj.Center == nil {
+		b := tj.Bounds
+		tj.Center = []float64{(b[0] + b[2]) / 2, (b[1] + b[3]) / 2, float64(tj.MinZoom)}
+	}
+	if tj.VectorLayers != nil {
+		tj.TileJSON = "3.0.0"
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if p := r.Header.Get("X-Forwarded-Proto"); p != "" {
+		scheme = p
+	}
+	tj.Tiles = []string{fmt.Sprintf("%s://%s/%s/{z}/{x}/{y}.%s", scheme, r.Host, layer, info.Format)}
+	return tj, nil
+}
+
+// applyMetadata takes the MBTiles metadata that TileJSON knows about.
+func (tj *TileJSON) applyMetadata(md *MBTilesMetadata) {
+	if md.Name != "" {
+		tj.Name = md.Name
+	}
+	if md.Description != defaultDescription {
+		tj.Description = md.Description
+	}
+	tj.Attribution = md.Attribution
+	if md.MaxZoom != 0 {
+		tj.MinZoom = md.MinZoom
+		tj.MaxZoom = md.MaxZoom
+	}
+	if md.Bounds != [4]float64{} {
+		tj.Bounds = md.Bounds[:]
+	}
+	if md.Center != [3]float64{} {
+		tj.Center = md.Center[:]
+	}
+	tj.VectorLayers = md.VectorLayers
+}
+
+// parseFloats parses a comma separated list such as the MBTiles bounds.
+func parseFloats(s string) []float64 {
+	if s == "" {
+		return nil
+	}
+	var fs []float64
+	for _, f := range strings.Split(s, ",") {
+		v, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+		if err != nil {
+			return nil
+		}
+		fs = append(fs, v)
+	}
+	return fs
+}
+
+func (t *TileServer) serveTileJSON(w http.ResponseWriter, r *http.Request, layer string) {
+	tj, err := t.TileJSON(r, layer)
+	if err != nil {
+		tileError(w, err)
+		return
+	}
+	writeJSON(w, tj)
+}
+
+// serveLayerIndex answers with the TileJSON documents of all layers.
+func (t *TileServer) serveLayerIndex(w http.ResponseWriter, r *http.Request) {
+	index := []*TileJSON{}
+	for _, layer := range t.lmp.Layers() {
+		tj, err := t.TileJSON(r, layer)
+		if err != nil {
+			// Removed in the meantime
+			continue
+		}
+		index = append(index, tj)
+	}
+	writeJSON(w, index)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
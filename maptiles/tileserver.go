@@ -1,215 +1,372 @@
 package maptiles
 
 import (
+	"bytes"
+	"context"
 	"crypto/md5"
-	"database/sql"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"regexp"
-	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/golang/groupcache"
 )
 
-var (
-	pool  *groupcache.HTTPPool
-	cache *groupcache.Group
-)
-
-// TODO serve list of registered layers per HTTP (preferably leafletjs-compatible js-array)
+// Layer names as in the tile patterns, see ParseTilePattern.
+var tileJSONRegex = regexp.MustCompile(`^/(` + tilePatternTokens["layer"] + `)\.json$`)
 
 // Handles HTTP requests for map tiles, caching any produced tiles
 // in an MBtiles 1.2 compatible sqlite db.
 type TileServer struct {
+	mu        sync.Mutex // guards m, stores, policies, gens and variants
 	m         map[string]*TileDb
+	stores    map[string]TileStore
+	policies  map[string]CachePolicy
+	gens      map[genBucket]uint64            // of the cache keys, see cacheKey
+	variants  map[string]map[tileVariant]bool // stored per layer, see Expire
 	lmp       *LayerMultiplex
 	TmsSchema bool
 	// cacheFile string
-	url       string
-	basedir   string
-	cache     *groupcache.Group
-	PathComps map[string]string
+	url     string
+	basedir string
+	cache   *groupcache.Group
+	pool    *groupcache.HTTPPool // nil without peering
+	parse   TileRequestParser    // of ServeHTTP
+	flight  flightGroup
+	// Number of maps rendering in parallel per Mapnik layer, defaults
+	// to the number of CPUs. See AddMapnikLayer.
+	MapnikPoolSize int
+	// How layers without a renderer of their own reach the upstream url,
+	// nil means DefaultUpstreamConfig. All such layers share one
+	// connection pool.
+	Upstream *UpstreamConfig
+}
+
+// NewTileServer serves tiles from the cache files in basedir, fetching
+// missing ones of layers without a renderer of their own from the
+// URLTemplate url. With an empty url such layers are not found. It uses
+// DefaultCacheConfig without peering; servers created later in the same
+// process get the group names "TileCache-2", "TileCache-3" and so on.
+func NewTileServer(url, basedir string) (*TileServer, error) {
+	cfg := DefaultCacheConfig
+	groups.Lock()
+	defer groups.Unlock()
+	for i := 2; groupcache.GetGroup(cfg.GroupName) != nil; i++ {
+		cfg.GroupName = fmt.Sprintf("%s-%d", DefaultCacheConfig.GroupName, i)
+	}
+	return newTileServerWithCache(url, basedir, cfg)
 }
 
-func NewTileServer(url, basedir string) *TileServer {
+func newTileServer(url, basedir string) *TileServer {
 	t := TileServer{}
 	t.lmp = NewLayerMultiplex()
 	t.url = url
 	t.basedir = basedir
 	os.Mkdir(t.basedir, 0755)
 	t.m = make(map[string]*TileDb)
-	pool = groupcache.NewHTTPPool(fmt.Sprintf("http://127.0.0.1:%v", 9999))
-	t.cache = groupcache.NewGroup("TileCache", 100*1048576, groupcache.GetterFunc(
-		func(ctx groupcache.Context, key string, dest groupcache.Sink) error {
-			fnParams := strings.Split(key, ":")
-			pathParams := strings.Split(fnParams[0], "/")
-			z, _ := strconv.ParseUint(pathParams[0], 0, 64)
-			x, _ := strconv.ParseUint(pathParams[1], 0, 64)
-			y, _ := strconv.ParseUint(pathParams[2], 0, 64)
-			fn := fnParams[1]
-			//flip y to match TMS spec
-			y = (1 << z) - 1 - y
-
-			var tileData []byte
-
-			db, err := sql.Open("sqlite3", fn)
-			if err != nil {
-				fmt.Printf("Error database. %s\n", err.Error())
-			}
-			defer db.Close()
-			queryString := `
-			SELECT tile_data
-			FROM tile_blobs
-			WHERE checksum=(
-				SELECT checksum
-				FROM layered_tiles
-				WHERE zoom_level=?
-				AND tile_column=?
-				AND tile_row=?
-				AND layer_id='0')`
-			row := db.QueryRow(queryString, z, x, y)
-			row.Scan(&tileData)
-			dest.SetBytes(tileData)
-			return nil
-		}))
-
+	t.stores = make(map[string]TileStore)
+	t.policies = make(map[string]CachePolicy)
+	t.gens = make(map[genBucket]uint64)
+	t.variants = make(map[string]map[tileVariant]bool)
+	t.parse, _ = PatternParser(DefaultTilePatterns...)
 	return &t
 }
 
-func (t *TileServer) ServeTileRequest(w http.ResponseWriter, r *http.Request, tc TileCoord) {
+// AddMapnikLayer serves the layer name by rendering the Mapnik XML
+// stylesheet instead of proxying the upstream url. Tiles are rendered
+// with a MapnikPool of MapnikPoolSize maps.
+func (t *TileServer) AddMapnikLayer(name, stylesheet string) error {
+	p, err := NewMapnikPool(stylesheet, t.MapnikPoolSize)
+	if err != nil {
+		return err
+	}
+	t.AddLayerRenderer(name, p)
+	return nil
+}
 
-	ch := make(chan TileFetchResult)
+// AddUpstreamLayer serves the layer name by proxying the URLTemplate url
+// as configured by Upstream.
+func (t *TileServer) AddUpstreamLayer(name, url string) error {
+	if _, err := ParseURLTemplate(url); err != nil {
+		return err
+	}
+	t.lmp.AddTileRenderer(name, NewUpstreamRenderer(url, t.Upstream))
+	return nil
+}
+
+// AddLayerRenderer serves the layer name with r instead of proxying the
+// upstream url. The server takes ownership of r.
+func (t *TileServer) AddLayerRenderer(name string, r Renderer) {
+	t.lmp.AddTileRenderer(name, r)
+}
 
-	tr := TileFetchRequest{tc, ch}
-	k := fmt.Sprintf("%s_%s_%s", tc.Layer, tc.Scale, tc.Format)
-	t.m[k].RequestQueue() <- tr
+func (t *TileServer) ServeTileRequest(w http.ResponseWriter, r *http.Request, tc TileCoord) {
 
-	result := <-ch
-	needsInsert := false
+	// The request context is cancelled when the client goes away, which
+	// aborts the db lookup and, unless other requests wait for the same
+	// tile, the upstream fetch as well.
+	ctx := r.Context()
+	store := t.LayerStore(tc.Layer)
+	blob, stamp, err := getStamped(ctx, store, tc)
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil && err != ErrTileNotFound {
+		// A broken cache is no reason to fail, render the tile instead
+		log.Println(err)
+	}
+	result := TileFetchResult{tc, blob, nil}
+	fetch := func(ctx context.Context) (TileFetchResult, error) {
+		result, err := t.lmp.FetchTile(ctx, tc)
+		result.Blob = canonicalTile(tc.Format, result.Blob)
+		return result, err
+	}
+	put := func(result TileFetchResult) {
+		t.addVariant(tc)
+		// insert newly rendered tile into cache
+		if err := store.Put(context.Background(), result.Coord, result.Blob); err != nil {
+			log.Println(err)
+		}
+	}
 
-	if result.Blob == nil {
-		// Tile was not provided by DB, so submit the tile request to the renderer
-		t.lmp.SubmitRequest(tr)
-		result = <-ch
-		if result.Blob == nil {
+	switch fresh := t.CachePolicy(tc.Layer).freshness(stamp, time.Now()); {
+	case result.Blob == nil:
+		// Tile was not provided by DB, so submit the tile request to the
+		// renderer unless another request already did
+		result, err = t.flight.do(ctx, storeKey(tc), fetch, put)
+		if err != nil {
 			// The tile could not be rendered, now we need to bail out.
-			http.NotFound(w, r)
+			if ctx.Err() != nil {
+				return
+			}
+			tileError(w, err)
+			return
+		}
+		stamp = time.Now()
+	case fresh == tileStale:
+		// Serve the stored tile now, later requests get the new one
+		go func() {
+			if _, err := t.flight.do(context.Background(), storeKey(tc), fetch, put); err != nil && err != ErrTileNotFound {
+				log.Println(err)
+			}
+		}()
+	case fresh == tileExpired:
+		fetched, err := t.flight.do(ctx, storeKey(tc), fetch, put)
+		if ctx.Err() != nil {
 			return
 		}
-		needsInsert = true
+		if err == nil {
+			result, stamp = fetched, time.Now()
+		} else {
+			// An outdated tile is better than none
+			log.Println(err)
+		}
 	}
 
-	if tc.Format == "vector.pbf" {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Content-Type", "application/x-protobuf")
-		// mapbox-gl-js need content-encoding=gzip
-		// Mapbox Studio tmsource don't like content-encoding=gzip
-		gz := r.FormValue("gz")
-		if v, ok := r.Form["gz"]; ok {
-			if false {
-				fmt.Println("Found", v, gz)
-			}
-			w.Header().Set("Content-Encoding", "gzip")
+	t.writeTile(w, r, tc, result.Blob, stamp)
+}
+
+// writeTile answers the request with the tile c stored at stamp, the zero
+// time if unknown. Vector tiles are sent in the content coding negotiated
+// by encodeTile. Conditional requests are answered by 304 Not Modified if
+// the ETag, the md5 sum of the bytes sent, matches or the tile was not
+// modified since.
+func (t *TileServer) writeTile(w http.ResponseWriter, r *http.Request, c TileCoord, blob []byte, stamp time.Time) {
+	h := w.Header()
+	h.Set("Content-Type", contentType(c.Format))
+	if c.Format == "vector.pbf" {
+		h.Set("Access-Control-Allow-Origin", "*")
+		// mapbox-gl-js wants gzip, Mapbox Studio tmsource no content
+		// coding at all, both say so in Accept-Encoding
+		h.Add("Vary", "Accept-Encoding")
+		encoded, coding, err := encodeTile(blob, r.Header.Get("Accept-Encoding"))
+		if err != nil {
+			tileError(w, err)
+			return
 		}
-	} else {
-		w.Header().Set("Content-Type", "image/png")
+		if coding != "" {
+			h.Set("Content-Encoding", coding)
+		}
+		blob = encoded
 	}
-	etag := fmt.Sprintf("%x", md5.Sum(result.Blob))
-	if r.Header.Get("If-None-Match") == etag {
-		w.WriteHeader(http.StatusNotModified)
-		return
+	if cc := t.CachePolicy(c.Layer).cacheControl(); cc != "" {
+		h.Set("Cache-Control", cc)
 	}
-	if len(result.Blob) > 0 {
-		w.Header().Set("Content-Length", fmt.Sprintf("%d", int64(len(result.Blob))))
+	h.Set("ETag", fmt.Sprintf("%q", fmt.Sprintf("%x", md5.Sum(blob))))
+	http.ServeContent(w, r, "", stamp, bytes.NewReader(blob))
+}
+
+// tileVariant is a scale and format of the tiles of a layer.
+type tileVariant struct {
+	scale, format string
+}
+
+// addVariant records the scale and format of the tile c as stored.
+func (t *TileServer) addVariant(c TileCoord) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.variants[c.Layer] == nil {
+		t.variants[c.Layer] = make(map[tileVariant]bool)
 	}
-	w.Header().Del("Vary")
-	w.Header().Add("ETag", etag)
-	_, err := w.Write(result.Blob)
-	if err != nil {
+	t.variants[c.Layer][tileVariant{c.Scale, c.Format}] = true
+}
+
+// DbStore returns the default TileStore of all layers, which keeps each
+// layer, scale and format in an MBTiles file in the base directory.
+func (t *TileServer) DbStore() TileStore {
+	return dbStore{t}
+}
+
+// SetLayerStore makes the layer keep its tiles in s instead of DbStore,
+// e.g. in a TieredStore.
+func (t *TileServer) SetLayerStore(layer string, s TileStore) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stores[layer] = s
+}
+
+// LayerStore returns the TileStore of the layer.
+func (t *TileServer) LayerStore(layer string) TileStore {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if s, ok := t.stores[layer]; ok {
+		return s
+	}
+	return dbStore{t}
+}
+
+// RenderStats returns how many tiles were fetched from the renderers and
+// how many requests were served by a fetch of another request.
+func (t *TileServer) RenderStats() RenderStats {
+	return t.flight.stats()
+}
+
+// tileDb returns the cache db of the layer for scale and format. Unless
+// create is set, nil is returned for a cache file that does not exist yet.
+func (t *TileServer) tileDb(l, scale, format string, create bool) *TileDb {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	k := fmt.Sprintf("%s_%s_%s", l, scale, format)
+	if m, ok := t.m[k]; ok {
+		return m
+	}
+	fn := fmt.Sprintf("%s/%s_%s.mbtiles", t.basedir, l, format)
+	if scale != "" {
+		fn = fmt.Sprintf("%s/%s_%s_%s.mbtiles", t.basedir, l, scale, format)
+	}
+	if _, err := os.Stat(fn); err != nil && !create {
+		return nil
+	}
+	m := NewTileDb(fn)
+	if m == nil {
+		return nil
+	}
+	m.path = fn
+	// One file per layer, so expose it through the MBTiles 'tiles' view
+	if err := m.SetDefaultLayer(l); err != nil {
+		log.Println(err)
+	}
+	if err := m.initMetadata(map[string]string{"name": l, "format": mbtilesFormat(format)}); err != nil {
 		log.Println(err)
 	}
-	if needsInsert {
-		t.m[k].InsertQueue() <- result // insert newly rendered tile into cache db
+	t.m[k] = m
+	return m
+}
+
+// tileError responds with the status code matching err, see httpStatus.
+// The body is kept short and never reveals upstream details.
+func tileError(w http.ResponseWriter, err error) {
+	code := httpStatus(err)
+	if code != http.StatusNotFound {
+		log.Println(err)
 	}
+	http.Error(w, fmt.Sprintf("%d %s", code, http.StatusText(code)), code)
 }
 
+// ServeHTTP serves the TileJSON documents and tiles at the
+// DefaultTilePatterns. Use Handler for other path patterns.
 func (t *TileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	var z, x, y uint64
-	var l, format, scale string
-	if len(t.PathComps) > 0 {
-		z, _ = strconv.ParseUint(t.PathComps["z"], 10, 64)
-		x, _ = strconv.ParseUint(t.PathComps["x"], 10, 64)
-		y, _ = strconv.ParseUint(t.PathComps["y"], 10, 64)
-		l = t.PathComps["layername"]
-		format = t.PathComps["format"]
-		scale = t.PathComps["scale"]
-	} else {
-		pathRegex := regexp.MustCompile(`/([-A-Za-z0-9]+)/([0-9]+)/([0-9]+)/([0-9]+)(@[0-9]+x)?\.(png[0-9]{0,3}|jpe?g1?[0-9]{0,2}|(vector\.)?pbf)`)
-		path := pathRegex.FindStringSubmatch(r.URL.Path)
+	if r.URL.Path == "/layers.json" {
+		t.serveLayerIndex(w, r)
+		return
+	}
+	if path := tileJSONRegex.FindStringSubmatch(r.URL.Path); path != nil {
+		t.serveTileJSON(w, r, path[1])
+		return
+	}
+	tc, err := t.parse(r)
+	if err != nil {
+		tileError(w, err)
+		return
+	}
+	tc.Tms = t.TmsSchema
+	t.serveTile(w, r, tc)
+}
 
-		if path == nil {
-			http.NotFound(w, r)
+// serveTile answers the request for tc, which carries the layer, the
+// position, the scale and the format as found in the request.
+func (t *TileServer) serveTile(w http.ResponseWriter, r *http.Request, tc TileCoord) {
+	tc.Format = strings.Replace(tc.Format, "jpg", "jpeg", 1)
+	if tc.Format == "pbf" {
+		tc.Format = "vector.pbf"
+	}
+	if !tc.valid() {
+		tileError(w, ErrInvalidCoord)
+		return
+	}
+	if info, ok := t.lmp.LayerInfo(tc.Layer); ok && !info.contains(tc) {
+		// Neither worth asking the upstream nor caching
+		if info.EmptyTile == nil {
+			tileError(w, ErrTileNotFound)
 			return
 		}
-
-		l = path[1]
-		z, _ = strconv.ParseUint(path[2], 10, 64)
-		x, _ = strconv.ParseUint(path[3], 10, 64)
-		y, _ = strconv.ParseUint(path[4], 10, 64)
-		scale = path[5]
-		format = path[6]
-	}
-	format = strings.Replace(format, "jpg", "jpeg", 1)
-	if format == "pbf" {
-		format = "vector.pbf"
+		t.writeTile(w, r, tc, info.EmptyTile, time.Time{})
+		return
 	}
 
-	k := fmt.Sprintf("%s_%s_%s", l, scale, format)
-	_, p1 := t.m[k]
-	var fn string
-	if !p1 {
-		fn = fmt.Sprintf("%s/%s_%s.mbtiles", t.basedir, l, format)
-		if scale != "" {
-			fn = fmt.Sprintf("%s/%s_%s_%s.mbtiles", t.basedir, l, scale, format)
+	if t.url == "" {
+		if !t.lmp.HasLayer(tc.Layer) {
+			tileError(w, UnknownLayerError{tc.Layer})
+			return
 		}
-		t.m[k] = NewTileDb(fn)
-		t.m[k].path = fn
-	}
-	_, present := t.lmp.layerChans[l]
-	if !present {
-		t.lmp.AddRenderer(l, t.url)
+	} else {
+		// Without an url of its own the renderer uses TileCoord.Url
+		t.lmp.AddTileRendererIfAbsent(tc.Layer, func() Renderer {
+			return NewUpstreamRenderer("", t.Upstream)
+		})
 	}
-	url := t.url
-	if format == "vector.pbf" {
-		url = strings.Replace(url, "tmstyle", "tmsource", 1)
-		url = strings.Replace(url, ".tm2", ".tm2source", 1)
-		url = strings.Replace(url, "/style", "/source", 1)
+	tc.Url = t.url
+	if tc.Format == "vector.pbf" {
+		tc.Url = strings.Replace(tc.Url, "tmstyle", "tmsource", 1)
+		tc.Url = strings.Replace(tc.Url, ".tm2", ".tm2source", 1)
+		tc.Url = strings.Replace(tc.Url, "/style", "/source", 1)
 	}
 
 	var data []byte
-	key := fmt.Sprintf("%d/%d/%d:%s", z, x, y, t.m[k].path)
-	err := t.cache.Get(nil, key, groupcache.AllocatingByteSliceSink(&data))
-	if err != nil {
+	err := t.cache.Get(r.Context(), t.cacheKey(tc), groupcache.AllocatingByteSliceSink(&data))
+	if err != nil && err != ErrTileNotFound {
 		log.Printf("Error groupcache. %s\n", err.Error())
 	}
-	if len(data) > 1 {
-		etag := fmt.Sprintf("%x", md5.Sum(data))
-		if r.Header.Get("If-None-Match") == etag {
-			w.WriteHeader(http.StatusNotModified)
-			return
-		}
-		w.Header().Add("ETag", etag)
-		w.Header().Set("Content-Length", fmt.Sprintf("%d", int64(len(data))))
-		w.Header().Del("Vary")
-		_, err := w.Write(data)
-		if err != nil {
-			log.Printf("Error write to response, %s", err.Error())
-		}
+	data, stamp := unstampTile(data)
+	if len(data) > 1 && t.CachePolicy(tc.Layer).freshness(stamp, time.Now()) == tileFresh {
+		t.writeTile(w, r, tc, data, stamp)
 		return
 	}
 
-	t.ServeTileRequest(w, r, TileCoord{x, y, z, t.TmsSchema, l, scale, url, format})
+	t.ServeTileRequest(w, r, tc)
+}
+
+// contentType returns the media type of tiles in format.
+func contentType(format string) string {
+	switch {
+	case format == "vector.pbf":
+		return "application/x-protobuf"
+	case strings.HasPrefix(format, "jp"):
+		return "image/jpeg"
+	}
+	return "image/png"
 }
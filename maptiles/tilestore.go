@@ -0,0 +1,283 @@
+package maptiles
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// TileStore keeps rendered tiles by their TileCoord, including layer,
+// scale and format. TileDb, FileStore and MemoryStore are TileStores,
+// TieredStore stacks them. Implementations must be safe for concurrent use.
+type TileStore interface {
+	// Get returns the tile c or ErrTileNotFound if it is not stored.
+	Get(ctx context.Context, c TileCoord) ([]byte, error)
+	Put(ctx context.Context, c TileCoord, blob []byte) error
+	// Delete removes the tile c, a tile that is not stored is no error.
+	Delete(ctx context.Context, c TileCoord) error
+	Has(ctx context.Context, c TileCoord) (bool, error)
+}
+
+// StampedStore is a TileStore that knows when its tiles were stored, which
+// the CachePolicy of a layer needs to tell fresh from stale tiles.
+type StampedStore interface {
+	TileStore
+	// GetStamped is Get that also returns when the tile was stored, the
+	// zero time if that is unknown.
+	GetStamped(ctx context.Context, c TileCoord) ([]byte, time.Time, error)
+	// PutStamped is Put that keeps the tile as stored at stamp, e.g. when
+	// copied from another store. The zero time means now.
+	PutStamped(ctx context.Context, c TileCoord, blob []byte, stamp time.Time) error
+}
+
+// RangePurger is a TileStore that removes the tiles of whole TileRanges
+// at once, for all scales and formats, see TileServer.Expire.
+type RangePurger interface {
+	TileStore
+	// PurgeRanges removes the tiles of the layer in the ranges and returns
+	// their number.
+	PurgeRanges(ctx context.Context, layer string, ranges []TileRange) (int64, error)
+}
+
+// getStamped reads the tile c from s. The timestamp is the zero time
+// unless s is a StampedStore.
+func getStamped(ctx context.Context, s TileStore, c TileCoord) ([]byte, time.Time, error) {
+	if ss, ok := s.(StampedStore); ok {
+		return ss.GetStamped(ctx, c)
+	}
+	blob, err := s.Get(ctx, c)
+	return blob, time.Time{}, err
+}
+
+// putStamped stores the tile c in s as stored at stamp, which is lost
+// unless s is a StampedStore.
+func putStamped(ctx context.Context, s TileStore, c TileCoord, blob []byte, stamp time.Time) error {
+	if ss, ok := s.(StampedStore); ok {
+		return ss.PutStamped(ctx, c, blob, stamp)
+	}
+	return s.Put(ctx, c, blob)
+}
+
+// Get returns the tile c of the layer c.Layer. Scale and Format are
+// ignored, they are implied by the file.
+func (m *TileDb) Get(ctx context.Context, c TileCoord) ([]byte, error) {
+	blob, err := m.FetchTile(ctx, c)
+	if err == nil && blob == nil {
+		err = ErrTileNotFound
+	}
+	return blob, err
+}
+
+// Put queues the tile like the InsertQueue does and waits until its batch
+// is committed, see TileDbOptions. It returns the error of this tile only.
+func (m *TileDb) Put(ctx context.Context, c TileCoord, blob []byte) error {
+	return m.PutStamped(ctx, c, blob, time.Time{})
+}
+
+// PutStamped is Put with the timestamp of the tile, the zero time means
+// the time of the commit.
+func (m *TileDb) PutStamped(ctx context.Context, c TileCoord, blob []byte, stamp time.Time) error {
+	done := make(chan error, 1)
+	select {
+	case m.putChan <- tileInsert{TileFetchResult{c, blob, nil}, stamp, done}:
+	case <-m.qc:
+		return fmt.Errorf("maptiles: tile db %s is closed", m.path)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Delete removes the tile c from its layer. The blob is kept, see
+// DeleteLayer.
+func (m *TileDb) Delete(ctx context.Context, c TileCoord) error {
+	id, ok := m.layerId(c.Layer)
+	if !ok {
+		return nil
+	}
+	c.setTMS(true)
+	_, err := m.db.ExecContext(ctx, "DELETE FROM layered_tiles WHERE layer_id=? AND zoom_level=? AND tile_column=? AND tile_row=?", id, c.Zoom, c.X, c.Y)
+	return err
+}
+
+func (m *TileDb) Has(ctx context.Context, c TileCoord) (bool, error) {
+	blob, err := m.FetchTile(ctx, c)
+	return blob != nil, err
+}
+
+// dbStore is the TileStore of a TileServer that keeps every layer, scale
+// and format in a cache file of its own, see TileServer.tileDb.
+type dbStore struct {
+	t *TileServer
+}
+
+func (s dbStore) db(c TileCoord) (*TileDb, error) {
+	if m := s.t.tileDb(c.Layer, c.Scale, c.Format, true); m != nil {
+		return m, nil
+	}
+	return nil, fmt.Errorf("maptiles: cannot open cache db of layer %s", c.Layer)
+}
+
+func (s dbStore) Get(ctx context.Context, c TileCoord) ([]byte, error) {
+	m, err := s.db(c)
+	if err != nil {
+		return nil, err
+	}
+	return m.Get(ctx, c)
+}
+
+func (s dbStore) GetStamped(ctx context.Context, c TileCoord) ([]byte, time.Time, error) {
+	m, err := s.db(c)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return m.GetStamped(ctx, c)
+}
+
+func (s dbStore) Put(ctx context.Context, c TileCoord, blob []byte) error {
+	m, err := s.db(c)
+	if err != nil {
+		return err
+	}
+	return m.Put(ctx, c, blob)
+}
+
+func (s dbStore) PutStamped(ctx context.Context, c TileCoord, blob []byte, stamp time.Time) error {
+	m, err := s.db(c)
+	if err != nil {
+		return err
+	}
+	return m.PutStamped(ctx, c, blob, stamp)
+}
+
+// Delete does not create the cache file of the tile.
+func (s dbStore) Delete(ctx context.Context, c TileCoord) error {
+	m := s.t.tileDb(c.Layer, c.Scale, c.Format, false)
+	if m == nil {
+		return nil
+	}
+	return m.Delete(ctx, c)
+}
+
+// Has does not create the cache file of the tile.
+func (s dbStore) Has(ctx context.Context, c TileCoord) (bool, error) {
+	m := s.t.tileDb(c.Layer, c.Scale, c.Format, false)
+	if m == nil {
+		return false, nil
+	}
+	return m.Has(ctx, c)
+}
+
+// PurgeRanges removes the tiles in the ranges from all cache files of the
+// layer. Files that do not exist are not created.
+func (s dbStore) PurgeRanges(ctx context.Context, layer string, ranges []TileRange) (int64, error) {
+	t := s.t
+	files, err := filepath.Glob(filepath.Join(t.basedir, layer+"_*.mbtiles"))
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	for _, fn := range files {
+		// layer_format.mbtiles or layer_@2x_format.mbtiles
+		rest := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(fn), layer+"_"), ".mbtiles")
+		var scale, format string
+		if i := strings.IndexByte(rest, '_'); i < 0 {
+			format = rest
+		} else if strings.HasPrefix(rest, "@") {
+			scale, format = rest[:i], rest[i+1:]
+		} else {
+			// belongs to another layer with an underscore in its name
+			continue
+		}
+		m := t.tileDb(layer, scale, format, false)
+		if m == nil {
+			continue
+		}
+		purged, err := m.PurgeRanges(ctx, layer, ranges)
+		if err != nil {
+			return n, err
+		}
+		n += purged
+	}
+	return n, nil
+}
+
+// TieredStore stacks stores from the fastest to the slowest, e.g.
+//
+//	TieredStore{NewMemoryStore(64 << 20), &FileStore{Dir: "tiles"}, t.DbStore()}
+//
+// Get tries the tiers in order and copies a tile found in a slower tier
+// into the faster ones. Put and Delete apply to all tiers. Copies keep the
+// timestamp of the tile in tiers that are a StampedStore.
+type TieredStore []TileStore
+
+func (ts TieredStore) Get(ctx context.Context, c TileCoord) ([]byte, error) {
+	blob, _, err := ts.GetStamped(ctx, c)
+	return blob, err
+}
+
+func (ts TieredStore) GetStamped(ctx context.Context, c TileCoord) ([]byte, time.Time, error) {
+	for i, s := range ts {
+		blob, stamp, err := getStamped(ctx, s, c)
+		if err == ErrTileNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		for _, faster := range ts[:i] {
+			if err := putStamped(ctx, faster, c, blob, stamp); err != nil {
+				log.Println(err)
+			}
+		}
+		return blob, stamp, nil
+	}
+	return nil, time.Time{}, ErrTileNotFound
+}
+
+func (ts TieredStore) Put(ctx context.Context, c TileCoord, blob []byte) error {
+	return ts.PutStamped(ctx, c, blob, time.Time{})
+}
+
+func (ts TieredStore) PutStamped(ctx context.Context, c TileCoord, blob []byte, stamp time.Time) error {
+	var first error
+	for _, s := range ts {
+		if err := putStamped(ctx, s, c, blob, stamp); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (ts TieredStore) Delete(ctx context.Context, c TileCoord) error {
+	var first error
+	for _, s := range ts {
+		if err := s.Delete(ctx, c); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (ts TieredStore) Has(ctx context.Context, c TileCoord) (bool, error) {
+	for _, s := range ts {
+		if ok, err := s.Has(ctx, c); ok || err != nil {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+// storeKey identifies the tile c independent of its row scheme.
+func storeKey(c TileCoord) string {
+	c.setTMS(false)
+	return fmt.Sprintf("%s/%s/%s/%d/%d/%d", c.Layer, c.Scale, c.Format, c.Zoom, c.X, c.Y)
+}
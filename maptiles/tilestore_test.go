@@ -0,0 +1,100 @@
+package maptiles
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// testStore test the TileStore contract on s.
+func testStore(t *testing.T, name string, s TileStore) {
+	ctx := context.Background()
+	c := TileCoord{X: 1, Y: 2, Zoom: 3, Layer: "osm", Format: "png"}
+	if _, err := s.Get(ctx, c); err != ErrTileNotFound {
+		t.Errorf("%s: Get of missing tile: got %v; want %v", name, err, ErrTileNotFound)
+	}
+	if err := s.Put(ctx, c, []byte("tile")); err != nil {
+		t.Fatalf("%s: Put: %v", name, err)
+	}
+	tms := c
+	tms.setTMS(true)
+	if blob, err := s.Get(ctx, tms); err != nil || string(blob) != "tile" {
+		t.Errorf("%s: Get: got %q, %v; want %q", name, blob, err, "tile")
+	}
+	if ok, err := s.Has(ctx, c); !ok || err != nil {
+		t.Errorf("%s: Has: got %v, %v; want true", name, ok, err)
+	}
+	if err := s.Delete(ctx, c); err != nil {
+		t.Errorf("%s: Delete: %v", name, err)
+	}
+	if ok, _ := s.Has(ctx, c); ok {
+		t.Errorf("%s: Has after Delete: got true", name)
+	}
+}
+
+// TestTileStores test the store implementations and stacking them.
+func TestTileStores(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tilestore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	m, cleanup := tempTileDb(t)
+	defer cleanup()
+
+	testStore(t, "MemoryStore", NewMemoryStore(1<<10))
+	testStore(t, "FileStore", &FileStore{Dir: dir})
+	testStore(t, "TileDb", m)
+
+	ctx := context.Background()
+	mem := NewMemoryStore(8)
+	for x := uint64(0); x < 3; x++ {
+		mem.Put(ctx, TileCoord{X: x, Zoom: 2}, []byte("tile"))
+	}
+	if n, size := mem.Len(); n != 2 || size != 8 {
+		t.Errorf("MemoryStore.Len: got %d, %d; want 2, 8", n, size)
+	}
+	if ok, _ := mem.Has(ctx, TileCoord{X: 0, Zoom: 2}); ok {
+		t.Error("MemoryStore: least recently used tile not evicted")
+	}
+
+	for _, c := range []TileCoord{{Layer: ".."}, {Layer: "a/b"}, {Format: `..\png`}, {Scale: "/x"}} {
+		if err := (&FileStore{Dir: dir}).Put(ctx, c, []byte("tile")); err == nil {
+			t.Errorf("FileStore.Put: tile %+v outside Dir accepted", c)
+		}
+	}
+
+	mem = NewMemoryStore(1 << 10)
+	files := &FileStore{Dir: dir}
+	tiers := TieredStore{mem, files}
+	testStore(t, "TieredStore", tiers)
+	c := TileCoord{X: 1, Zoom: 1, Layer: "osm", Format: "png"}
+	files.Put(ctx, c, []byte("disk"))
+	if blob, err := tiers.Get(ctx, c); err != nil || string(blob) != "disk" {
+		t.Errorf("TieredStore.Get: got %q, %v; want %q", blob, err, "disk")
+	}
+	if blob, _ := mem.Get(ctx, c); string(blob) != "disk" {
+		t.Errorf("TieredStore.Get: memory tier not filled, got %q", blob)
+	}
+
+	// Copies are as old as the tile they were made of
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	c.X = 0
+	if err := files.PutStamped(ctx, c, []byte("old"), old); err != nil {
+		t.Fatal(err)
+	}
+	if _, stamp, err := tiers.GetStamped(ctx, c); err != nil || !stamp.Equal(old) {
+		t.Errorf("TieredStore.GetStamped: got %v, %v; want %v", stamp, err, old)
+	}
+	if _, stamp, _ := mem.GetStamped(ctx, c); !stamp.Equal(old) {
+		t.Errorf("TieredStore.GetStamped: memory tier stamped %v; want %v", stamp, old)
+	}
+	if err := m.PutStamped(ctx, c, []byte("old"), old); err != nil {
+		t.Fatal(err)
+	}
+	if _, stamp, _ := m.GetStamped(ctx, c); !stamp.Equal(old) {
+		t.Errorf("TileDb.PutStamped: stamped %v; want %v", stamp, old)
+	}
+}
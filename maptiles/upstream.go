@@ -0,0 +1,70 @@
+package maptiles
+
+import (
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// UpstreamConfig describes how a TileRenderer talks to its upstream tile
+// server. Renderers sharing the same *UpstreamConfig share one
+// http.Client and thereby its pool of keep-alive connections. The config
+// must not be modified once a renderer has used it.
+type UpstreamConfig struct {
+	Timeout         time.Duration // per attempt including the body read, 0 means 30s
+	Header          http.Header   // added to every request, e.g. User-Agent or API keys
+	Username        string        // enables basic auth
+	Password        string
+	BearerToken     string   // sent as "Authorization: Bearer ...", wins over basic auth
+	Proxy           *url.URL // nil means the proxy from the environment
+	MaxConnsPerHost int      // limit of concurrent connections per upstream host, 0 means no limit
+	Retry           RetryPolicy
+	Subdomains      []string // for {s} in URL templates, nil means DefaultSubdomains
+
+	once   sync.Once
+	client *http.Client
+}
+
+// Used by NewTileRenderer and for layers a TileServer proxies without an
+// explicit config.
+var DefaultUpstreamConfig = &UpstreamConfig{
+	Timeout: 30 * time.Second,
+	Retry:   DefaultRetryPolicy,
+}
+
+// Client returns the http.Client for the config, creating it on first use.
+func (c *UpstreamConfig) Client() *http.Client {
+	c.once.Do(func() {
+		tr := http.DefaultTransport.(*http.Transport).Clone()
+		if c.Proxy != nil {
+			tr.Proxy = http.ProxyURL(c.Proxy)
+		}
+		tr.MaxConnsPerHost = c.MaxConnsPerHost
+		// Tile clients fetch many small tiles from few hosts, so keep more
+		// than the default two idle connections around.
+		tr.MaxIdleConnsPerHost = 16
+		if c.MaxConnsPerHost > 0 {
+			tr.MaxIdleConnsPerHost = c.MaxConnsPerHost
+		}
+		timeout := c.Timeout
+		if timeout <= 0 {
+			timeout = 30 * time.Second
+		}
+		c.client = &http.Client{Transport: tr, Timeout: timeout}
+	})
+	return c.client
+}
+
+// authorize adds the configured headers and credentials to req.
+func (c *UpstreamConfig) authorize(req *http.Request) {
+	for k, v := range c.Header {
+		req.Header[k] = append([]string(nil), v...)
+	}
+	switch {
+	case c.BearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+c.BearerToken)
+	case c.Username != "":
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+}
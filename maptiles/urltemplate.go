@@ -0,0 +1,139 @@
+package maptiles
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Tokens understood in upstream URL templates. Each token may appear any
+// number of times.
+//
+//	{z}, {x}, {y}  tile coordinates in Google/XYZ scheme
+//	{-y}           y in TMS scheme
+//	{s}            subdomain, chosen per tile from UpstreamConfig.Subdomains
+//	{quadkey}      Bing Maps quadkey
+//	{scale}        scale suffix such as "@2x", empty for scale 1
+//	{bbox}         tile bounds in EPSG:3857 as minx,miny,maxx,maxy
+//	{layer}        layer name
+//	{format}       tile format, jpg is passed as jpeg
+var urlTokens = map[string]bool{
+	"z": true, "x": true, "y": true, "-y": true, "s": true,
+	"quadkey": true, "scale": true, "bbox": true, "layer": true, "format": true,
+}
+
+// Subdomains used for {s} unless UpstreamConfig.Subdomains says otherwise.
+var DefaultSubdomains = []string{"a", "b", "c"}
+
+// Parsed upstream URL template, see ParseURLTemplate.
+type URLTemplate struct {
+	raw   string
+	parts []string // literals at even, token names at odd indices
+	scale bool     // template has a {scale} token
+}
+
+// ParseURLTemplate checks the tokens of the template s. Templates without
+// a {scale} token get the scale suffix appended to {y} and {-y}, as Mapbox
+// Studio expects it.
+func ParseURLTemplate(s string) (*URLTemplate, error) {
+	t := &URLTemplate{raw: s}
+	rest := s
+	for {
+		open := strings.IndexByte(rest, '{')
+		if close := strings.IndexByte(rest, '}'); close >= 0 && (open < 0 || close < open) {
+			return nil, fmt.Errorf("maptiles: url template %q: unexpected '}'", s)
+		}
+		if open < 0 {
+			t.parts = append(t.parts, rest)
+			return t, nil
+		}
+		n := strings.IndexByte(rest[open:], '}')
+		if n < 0 {
+			return nil, fmt.Errorf("maptiles: url template %q: unclosed '{'", s)
+		}
+		token := rest[open+1 : open+n]
+		if !urlTokens[token] {
+			return nil, fmt.Errorf("maptiles: url template %q: unknown token {%s}", s, token)
+		}
+		t.scale = t.scale || token == "scale"
+		t.parts = append(t.parts, rest[:open], token)
+		rest = rest[open+n+1:]
+	}
+}
+
+func (t *URLTemplate) String() string {
+	return t.raw
+}
+
+// Expand fills in the tokens for the tile c. subdomains may be nil to use
+// DefaultSubdomains.
+func (t *URLTemplate) Expand(c TileCoord, subdomains []string) string {
+	c.setTMS(false)
+	if len(subdomains) == 0 {
+		subdomains = DefaultSubdomains
+	}
+	var b strings.Builder
+	for i, part := range t.parts {
+		if i%2 == 0 {
+			b.WriteString(part)
+			continue
+		}
+		switch part {
+		case "z":
+			b.WriteString(strconv.FormatUint(c.Zoom, 10))
+		case "x":
+			b.WriteString(strconv.FormatUint(c.X, 10))
+		case "y":
+			b.WriteString(strconv.FormatUint(c.Y, 10))
+			if !t.scale {
+				b.WriteString(c.Scale)
+			}
+		case "-y":
+			b.WriteString(strconv.FormatUint((1<<c.Zoom)-c.Y-1, 10))
+			if !t.scale {
+				b.WriteString(c.Scale)
+			}
+		case "s":
+			// Same tile, same subdomain, so caches along the way stay useful
+			b.WriteString(subdomains[(c.X+c.Y)%uint64(len(subdomains))])
+		case "quadkey":
+			b.WriteString(quadkey(c.Zoom, c.X, c.Y))
+		case "scale":
+			b.WriteString(c.Scale)
+		case "bbox":
+			bbox := tileToMercBBox(c.Zoom, c.X, c.Y)
+			for j, v := range bbox {
+				if j > 0 {
+					b.WriteByte(',')
+				}
+				b.WriteString(strconv.FormatFloat(v, 'f', -1, 64))
+			}
+		case "layer":
+			b.WriteString(c.Layer)
+		case "format":
+			if c.Format == "jpg" {
+				b.WriteString("jpeg")
+			} else {
+				b.WriteString(c.Format)
+			}
+		}
+	}
+	return b.String()
+}
+
+// quadkey computes the Bing Maps tile key of a Google tile.
+func quadkey(zoom, x, y uint64) string {
+	key := make([]byte, zoom)
+	for i := uint64(0); i < zoom; i++ {
+		mask := uint64(1) << (zoom - 1 - i)
+		d := byte('0')
+		if x&mask != 0 {
+			d++
+		}
+		if y&mask != 0 {
+			d += 2
+		}
+		key[i] = d
+	}
+	return string(key)
+}
@@ -0,0 +1,39 @@
+package maptiles
+
+import "testing"
+
+// TestURLTemplate test token expansion of upstream url templates.
+func TestURLTemplate(t *testing.T) {
+	tc := TileCoord{X: 3, Y: 5, Zoom: 3, Layer: "street", Scale: "@2x", Format: "jpg"}
+	tests := []struct {
+		tmpl string
+		want string
+	}{
+		{"http://{s}.tile/{z}/{x}/{y}.png", "http://c.tile/3/3/5@2x.png"},
+		{"http://tile/{z}/{x}/{y}{scale}.{format}?l={layer}", "http://tile/3/3/5@2x.jpeg?l=street"},
+		{"http://tms/{z}/{x}/{-y}.png", "http://tms/3/3/2@2x.png"},
+		{"http://bing/{quadkey}.jpeg?k={quadkey}", "http://bing/213.jpeg?k=213"},
+		{"http://tile/{z}/{z}", "http://tile/3/3"},
+	}
+	for _, test := range tests {
+		tmpl, err := ParseURLTemplate(test.tmpl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := tmpl.Expand(tc, nil); got != test.want {
+			t.Errorf("Expand(%q): got %q; want %q", test.tmpl, got, test.want)
+		}
+	}
+
+	tmpl, _ := ParseURLTemplate("wms?BBOX={bbox}")
+	want := "wms?BBOX=-20037508.342789244,-20037508.342789244,20037508.342789244,20037508.342789244"
+	if got := tmpl.Expand(TileCoord{}, nil); got != want {
+		t.Errorf("Expand bbox: got %q; want %q", got, want)
+	}
+
+	for _, bad := range []string{"http://tile/{z}/{x}/{y", "http://tile/{zoom}", "http://tile/}"} {
+		if _, err := ParseURLTemplate(bad); err == nil {
+			t.Errorf("ParseURLTemplate(%q): got no error", bad)
+		}
+	}
+}
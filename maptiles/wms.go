@@ -0,0 +1,135 @@
+package maptiles
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Fetches tiles from a WMS 1.1.1 or 1.3.0 server with GetMap requests.
+// Register it with LayerMultiplex.AddSource(name, NewRendererChan(s)) or
+// TileServer.AddLayerRenderer.
+type WMSSource struct {
+	URL     string   // GetMap endpoint, may already carry vendor parameters such as MAP
+	Version string   // "1.1.1" (default) or "1.3.0"
+	Layers  []string // LAYERS, at least one
+	Styles  []string // STYLES, empty means default styles
+	// "EPSG:3857" (default) or "EPSG:900913". Tiles are square in Web
+	// Mercator, so geographic CRS like EPSG:4326 would need the images to
+	// be reprojected and are not supported.
+	CRS         string
+	Format      string // FORMAT, empty means image/ plus TileCoord.Format, or image/png
+	Transparent bool
+	Upstream    *UpstreamConfig // nil means DefaultUpstreamConfig
+
+	once sync.Once
+	http *TileRenderer
+}
+
+// Validate checks the configuration, e.g. before registering the source.
+func (s *WMSSource) Validate() error {
+	switch {
+	case s.URL == "":
+		return fmt.Errorf("maptiles: wms source without url")
+	case len(s.Layers) == 0:
+		return fmt.Errorf("maptiles: wms source %s without layers", s.URL)
+	}
+	switch s.Version {
+	case "", "1.1.1", "1.3.0":
+	default:
+		return fmt.Errorf("maptiles: unsupported wms version %q", s.Version)
+	}
+	switch s.CRS {
+	case "", "EPSG:3857", "EPSG:900913":
+	default:
+		return fmt.Errorf("maptiles: unsupported wms crs %q", s.CRS)
+	}
+	return nil
+}
+
+// GetMapURL builds the GetMap request for the tile c.
+func (s *WMSSource) GetMapURL(c TileCoord) (string, error) {
+	if err := s.Validate(); err != nil {
+		return "", err
+	}
+	if !c.valid() {
+		return "", ErrInvalidCoord
+	}
+	c.setTMS(false)
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		return "", err
+	}
+
+	version := s.Version
+	if version == "" {
+		version = "1.1.1"
+	}
+	crs := s.CRS
+	if crs == "" {
+		crs = "EPSG:3857"
+	}
+	bbox := tileToMercBBox(c.Zoom, c.X, c.Y)
+	format := s.Format
+	if format == "" {
+		switch c.Format {
+		case "", "png":
+			format = "image/png"
+		case "jpg":
+			format = "image/jpeg"
+		default:
+			format = "image/" + c.Format
+		}
+	}
+	size := strconv.Itoa(256 * int(scaleFactor(c.Scale)))
+
+	q := u.Query()
+	q.Set("SERVICE", "WMS")
+	q.Set("REQUEST", "GetMap")
+	q.Set("VERSION", version)
+	q.Set("LAYERS", strings.Join(s.Layers, ","))
+	q.Set("STYLES", strings.Join(s.Styles, ","))
+	if version == "1.3.0" {
+		q.Set("CRS", crs)
+	} else {
+		q.Set("SRS", crs)
+	}
+	bs := make([]string, len(bbox))
+	for i, v := range bbox {
+		bs[i] = strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	q.Set("BBOX", strings.Join(bs, ","))
+	q.Set("WIDTH", size)
+	q.Set("HEIGHT", size)
+	q.Set("FORMAT", format)
+	q.Set("TRANSPARENT", strings.ToUpper(strconv.FormatBool(s.Transparent)))
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// RenderTile fetches c from the WMS server, retrying as configured by
+// Upstream. Service exceptions are reported as *UpstreamError.
+func (s *WMSSource) RenderTile(ctx context.Context, c TileCoord) ([]byte, error) {
+	u, err := s.GetMapURL(c)
+	if err != nil {
+		return nil, err
+	}
+	s.once.Do(func() {
+		s.http = NewUpstreamRenderer("", s.Upstream)
+	})
+	return s.http.get(ctx, u)
+}
+
+// isServiceException reports whether contentType denotes an OGC service
+// exception report rather than an image.
+func isServiceException(contentType string) bool {
+	ct := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	switch ct {
+	case "application/vnd.ogc.se_xml", "application/vnd.ogc.se+xml", "text/xml", "application/xml":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+package maptiles
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestWMSSource test GetMap requests against a WMS stand-in.
+func TestWMSSource(t *testing.T) {
+	var query map[string][]string
+	wms := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		if r.URL.Query().Get("LAYERS") == "missing" {
+			w.Header().Set("Content-Type", "application/vnd.ogc.se_xml")
+			w.Write([]byte(`<ServiceExceptionReport><ServiceException code="LayerNotDefined"/></ServiceExceptionReport>`))
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("png"))
+	}))
+	defer wms.Close()
+
+	s := &WMSSource{
+		URL:         wms.URL + "/wms?MAP=base",
+		Version:     "1.3.0",
+		Layers:      []string{"roads", "water"},
+		Transparent: true,
+	}
+	lmp := NewLayerMultiplex()
+	lmp.AddSource("base", NewRendererChan(s))
+	result, err := lmp.FetchTile(context.Background(), TileCoord{Zoom: 1, Layer: "base"})
+	if err != nil || string(result.Blob) != "png" {
+		t.Fatalf("FetchTile: got %q, %v; want %q", result.Blob, err, "png")
+	}
+	want := map[string]string{
+		"MAP":         "base",
+		"REQUEST":     "GetMap",
+		"VERSION":     "1.3.0",
+		"LAYERS":      "roads,water",
+		"CRS":         "EPSG:3857",
+		"BBOX":        "-20037508.342789244,0,0,20037508.342789244",
+		"WIDTH":       "256",
+		"FORMAT":      "image/png",
+		"TRANSPARENT": "TRUE",
+	}
+	for k, v := range want {
+		if got := query[k]; len(got) != 1 || got[0] != v {
+			t.Errorf("%s: got %v; want %q", k, got, v)
+		}
+	}
+
+	s = &WMSSource{URL: wms.URL, Layers: []string{"missing"}, Upstream: &UpstreamConfig{}}
+	if _, err := s.RenderTile(context.Background(), TileCoord{}); err == nil {
+		t.Error("RenderTile: service exception not reported")
+	}
+	if err := (&WMSSource{URL: wms.URL}).Validate(); err == nil {
+		t.Error("Validate: source without layers accepted")
+	}
+	if err := (&WMSSource{URL: wms.URL, Layers: []string{"roads"}, CRS: "EPSG:4326"}).Validate(); err == nil {
+		t.Error("Validate: geographic crs accepted")
+	}
+}